@@ -18,25 +18,189 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
 
+	"github.com/go-logr/logr"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/driver"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
 )
 
-func init() {
-	flag.Set("logtostderr", "true")
-}
-
 var (
 	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("nodeid", "", "node id")
+	mode     = flag.String("mode", driver.DefaultConfig().Mode, "services this instance is deployed for: controller, node or all, selects readiness checks and node background work")
+
+	s3MaxRetries     = flag.Int("s3-max-retries", s3.DefaultRetryPolicy.MaxRetries, "number of retries of S3 operations failed with transient errors")
+	s3InitialBackoff = flag.Duration("s3-initial-backoff", s3.DefaultRetryPolicy.InitialBackoff, "delay before the first retry of an S3 operation")
+	s3MaxBackoff     = flag.Duration("s3-max-backoff", s3.DefaultRetryPolicy.MaxBackoff, "maximum delay between retries of an S3 operation")
+	s3RateLimit      = flag.Float64("s3-rate-limit", s3.DefaultRateLimit, "maximum number of S3 requests per second to a single endpoint, 0 means unlimited")
+	s3RateBurst      = flag.Int("s3-rate-burst", s3.DefaultRateBurst, "maximum burst of S3 requests to a single endpoint")
+
+	fuseMemoryLimit     = flag.String("fuse-memory-limit", "", "memory limit of every FUSE daemon, like 512Mi, may be overridden by the memoryLimit volume attribute")
+	fuseCPULimit        = flag.String("fuse-cpu-limit", "", "CPU limit of every FUSE daemon, like 500m, may be overridden by the cpuLimit volume attribute")
+	fuseSlice           = flag.String("fuse-slice", mounter.DefaultLimits.Slice, "systemd slice to run FUSE daemons in")
+	fuseUID             = flag.Int("fuse-uid", mounter.DefaultLimits.UID, "user GeeseFS switches to after mounting")
+	fuseGID             = flag.Int("fuse-gid", mounter.DefaultLimits.GID, "group GeeseFS switches to after mounting")
+	fuseNoNewPrivileges = flag.Bool("fuse-no-new-privileges", mounter.DefaultLimits.NoNewPrivileges, "set NoNewPrivileges for systemd units of FUSE daemons")
+	fusePrivateTmp      = flag.Bool("fuse-private-tmp", mounter.DefaultLimits.PrivateTmp, "set PrivateTmp for systemd units of FUSE daemons")
+	fuseProtectSystem   = flag.String("fuse-protect-system", mounter.DefaultLimits.ProtectSystem, "ProtectSystem value for systemd units of FUSE daemons")
+
+	cacheRoot        = flag.String("cache-root", mounter.DefaultCache.Root, "directory for local disk caches of FUSE daemons, outside of /csi it must be mounted at the same path as on the host")
+	cacheBudget      = flag.String("cache-budget", "", "total size of local disk caches on the node, like 100Gi, unlimited if empty")
+	cacheDefaultSize = flag.String("cache-default-size", "1Gi", "size charged to --cache-budget for caches of volumes without cacheSize, 0 makes them fail to mount")
+
+	mountOptionPolicy = flag.String("mount-option-policy", "", "YAML file with allowed and forbidden mount options of every mounter")
+
+	mountCheckInterval  = flag.Duration("mount-check-interval", driver.DefaultConfig().MountCheckInterval, "interval of FUSE mount health checks on the node, 0 disables them")
+	stateFile           = flag.String("state-file", driver.DefaultConfig().StateFile, "file to keep the list of staged volumes in to restore their mounts after a restart, empty disables it")
+	maxConcurrentMounts = flag.Int("max-concurrent-mounts", 0, "maximum number of FUSE daemons starting at the same time on the node, 0 means unlimited")
+
+	mounterPods         = flag.Bool("mounter-pods", false, "run FUSE daemons in dedicated pods on the node instead of systemd units")
+	mounterPodNamespace = flag.String("mounter-pod-namespace", driver.DefaultConfig().MounterPodNamespace, "namespace of mounter pods")
+	mounterPodImage     = flag.String("mounter-pod-image", "", "image of mounter pods, usually the image of the driver")
+
+	ephemeralPodOptions = flag.Bool("ephemeral-pod-options", false, "allow pod specs to set mounter, options, memoryLimit, cpuLimit, cacheSize and cacheMode of ephemeral volumes")
+
+	metricsAddress = flag.String("metrics-address", "", "address to serve Prometheus metrics on, like :9810, empty disables them")
+	healthAddress  = flag.String("health-address", "", "address to serve /healthz and /readyz on, like :9809, empty disables them")
+
+	tracingEndpoint    = flag.String("tracing-endpoint", "", "host:port of the OTLP gRPC receiver to export OpenTelemetry traces to, empty disables tracing")
+	tracingInsecure    = flag.Bool("tracing-insecure", false, "connect to the OTLP receiver without TLS")
+	tracingSampleRatio = flag.Float64("tracing-sample-ratio", driver.DefaultConfig().TracingSampleRatio, "share of traces started by the driver which are exported, traces of callers follow their sampling decision")
+
+	logFormat = flag.String("log-format", "text", "format of logs, text or json")
 )
 
+// setupLogging switches klog to the requested format. JSON logs are written by slog, one object per line,
+// with the verbosity of klog
+func setupLogging(format string) error {
+	switch format {
+	case "text":
+		return nil
+	case "json":
+		verbosity, err := strconv.Atoi(flag.Lookup("v").Value.String())
+		if err != nil {
+			return err
+		}
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+			// logr maps V(n) to slog level -n
+			Level: slog.Level(-verbosity),
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey && len(groups) == 0 {
+					if level, ok := a.Value.Any().(slog.Level); ok {
+						a = slog.String(slog.LevelKey, logLevelName(level))
+					}
+				}
+				return a
+			},
+		})
+		klog.SetLogger(logr.FromSlogHandler(handler))
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// logLevelName maps slog levels of logr to common level names: errors, V(0) messages
+// as info and messages of higher verbosity as debug
+func logLevelName(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "error"
+	case level >= slog.LevelInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
 func main() {
+	klog.InitFlags(nil)
 	flag.Parse()
+	if err := setupLogging(*logFormat); err != nil {
+		log.Fatalf("Invalid --log-format: %v", err)
+	}
+
+	s3.DefaultRetryPolicy = s3.RetryPolicy{
+		MaxRetries:     *s3MaxRetries,
+		InitialBackoff: *s3InitialBackoff,
+		MaxBackoff:     *s3MaxBackoff,
+	}
+	s3.DefaultRateLimit = *s3RateLimit
+	s3.DefaultRateBurst = *s3RateBurst
+
+	limits := mounter.Limits{
+		Slice:           *fuseSlice,
+		UID:             *fuseUID,
+		GID:             *fuseGID,
+		NoNewPrivileges: *fuseNoNewPrivileges,
+		PrivateTmp:      *fusePrivateTmp,
+		ProtectSystem:   *fuseProtectSystem,
+	}
+	if *fuseMemoryLimit != "" {
+		q, err := resource.ParseQuantity(*fuseMemoryLimit)
+		if err != nil {
+			log.Fatalf("Invalid --fuse-memory-limit: %v", err)
+		}
+		limits.MemoryMax = q.Value()
+	}
+	if *fuseCPULimit != "" {
+		q, err := resource.ParseQuantity(*fuseCPULimit)
+		if err != nil {
+			log.Fatalf("Invalid --fuse-cpu-limit: %v", err)
+		}
+		limits.CPUMillicores = q.MilliValue()
+	}
+	mounter.DefaultLimits = limits
+	mounter.DefaultCache.Root = *cacheRoot
+	if *cacheBudget != "" {
+		q, err := resource.ParseQuantity(*cacheBudget)
+		if err != nil {
+			log.Fatalf("Invalid --cache-budget: %v", err)
+		}
+		mounter.DefaultCache.Budget = q.Value()
+	}
+	if *cacheDefaultSize != "" {
+		q, err := resource.ParseQuantity(*cacheDefaultSize)
+		if err != nil {
+			log.Fatalf("Invalid --cache-default-size: %v", err)
+		}
+		mounter.DefaultCache.DefaultSize = q.Value()
+	}
+	if *mountOptionPolicy != "" {
+		policy, err := mounter.LoadPolicy(*mountOptionPolicy)
+		if err != nil {
+			log.Fatalf("Failed to load mount option policy: %v", err)
+		}
+		mounter.DefaultPolicy = policy
+	}
+
+	config := driver.DefaultConfig()
+	config.Mode = *mode
+	config.MountCheckInterval = *mountCheckInterval
+	config.StateFile = *stateFile
+	config.MaxConcurrentMounts = *maxConcurrentMounts
+	if *mounterPods && *mounterPodImage == "" {
+		log.Fatal("--mounter-pod-image is required with --mounter-pods")
+	}
+	config.MounterPods = *mounterPods
+	config.MounterPodNamespace = *mounterPodNamespace
+	config.MounterPodImage = *mounterPodImage
+	config.EphemeralPodOptions = *ephemeralPodOptions
+	config.MetricsAddress = *metricsAddress
+	config.HealthAddress = *healthAddress
+	config.TracingEndpoint = *tracingEndpoint
+	config.TracingInsecure = *tracingInsecure
+	config.TracingSampleRatio = *tracingSampleRatio
 
-	driver, err := driver.New(*nodeID, *endpoint)
+	driver, err := driver.New(*nodeID, *endpoint, config)
 	if err != nil {
 		log.Fatal(err)
 	}
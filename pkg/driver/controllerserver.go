@@ -25,21 +25,22 @@ import (
 	"path"
 	"strings"
 
-	"github.com/golang/glog"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 )
 
 type controllerServer struct {
 	csi.UnimplementedControllerServer
-	driver *driver
+	driver   *driver
+	inFlight *inFlight
 }
 
-func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, err error) {
 	params := req.GetParameters()
 	capacityBytes := int64(req.GetCapacityRange().GetRequiredBytes())
 	volumeID := sanitizeVolumeID(req.GetName())
@@ -60,10 +61,47 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if req.GetVolumeCapabilities() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	if err := cs.inFlight.acquire(volumeID); err != nil {
+		return nil, err
+	}
+	defer cs.inFlight.release(volumeID)
+
+	logger := klog.FromContext(ctx).WithValues("volumeID", volumeID)
+	logger.V(4).Info("Creating volume", "bucket", bucketName, "prefix", prefix)
+	defer func() {
+		if err != nil {
+			cs.driver.provisioningFailureEvent(ctx, volumeID, params, req.GetSecrets(), err)
+		}
+	}()
 
-	glog.V(4).Infof("Got a request to create volume %s", volumeID)
+	// DeleteVolume lacks VolumeContext, but publish&unpublish requests have it,
+	// so we don't need to store additional metadata anywhere
+	volContext := make(map[string]string)
+	for k, v := range params {
+		if k != topologyEndpointsKey {
+			volContext[k] = v
+		}
+	}
+	var accessibleTopology []*csi.Topology
+	if params[topologyEndpointsKey] != "" && req.GetAccessibilityRequirements() != nil {
+		endpoints, err := parseTopologyEndpoints(params[topologyEndpointsKey])
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		endpoint := selectTopologyEndpoint(endpoints, req.GetAccessibilityRequirements())
+		if endpoint == nil {
+			return nil, status.Errorf(codes.ResourceExhausted, "None of %s matches accessibility requirements of the volume", topologyEndpointsKey)
+		}
+		logger.V(4).Info("Creating volume in the endpoint of its topology", "endpoint", endpoint.Endpoint, "topology", endpoint.Topology)
+		volContext[endpointKey] = endpoint.Endpoint
+		if endpoint.Region != "" {
+			volContext[regionKey] = endpoint.Region
+		}
+		accessibleTopology = []*csi.Topology{{Segments: endpoint.Topology}}
+		volumeID = topologyVolumeID(volumeID, endpoint)
+	}
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	client, err := s3.NewClientFromSecret(ctx, volumeSecrets(req.GetSecrets(), volContext))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
@@ -83,19 +121,14 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, fmt.Errorf("failed to create prefix %s: %v", prefix, err)
 	}
 
-	glog.V(4).Infof("create volume %s", volumeID)
-	// DeleteVolume lacks VolumeContext, but publish&unpublish requests have it,
-	// so we don't need to store additional metadata anywhere
-	volContext := make(map[string]string)
-	for k, v := range params {
-		volContext[k] = v
-	}
+	logger.V(4).Info("Volume is created")
 	volContext["capacity"] = fmt.Sprintf("%v", capacityBytes)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volumeID,
-			CapacityBytes: capacityBytes,
-			VolumeContext: volContext,
+			VolumeId:           volumeID,
+			CapacityBytes:      capacityBytes,
+			VolumeContext:      volContext,
+			AccessibleTopology: accessibleTopology,
 		},
 	}, nil
 }
@@ -108,10 +141,17 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if err := cs.inFlight.acquire(volumeID); err != nil {
+		return nil, err
+	}
+	defer cs.inFlight.release(volumeID)
 
-	glog.V(4).Infof("Deleting volume %s", volumeID)
+	logger := klog.FromContext(ctx)
+	logger.V(4).Info("Deleting volume", "bucket", bucketName, "prefix", prefix)
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	// the volume may be created in the endpoint of its topology, which is kept in its ID
+	_, volContext := splitVolumeID(volumeID)
+	client, err := s3.NewClientFromSecret(ctx, volumeSecrets(req.GetSecrets(), volContext))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
@@ -122,17 +162,16 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		if err := client.RemoveBucket(bucketName); err != nil && err.Error() != "The specified bucket does not exist" {
 			deleteErr = err
 		}
-		glog.V(4).Infof("Bucket %s removed", bucketName)
 	} else {
 		if err := client.RemovePrefix(bucketName, prefix); err != nil {
 			deleteErr = fmt.Errorf("unable to remove prefix: %w", err)
 		}
-		glog.V(4).Infof("Prefix %s removed", prefix)
 	}
 
 	if deleteErr != nil {
 		return nil, deleteErr
 	}
+	logger.V(4).Info("Volume is deleted")
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
@@ -146,8 +185,12 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
 	bucketName, _ := volumeIDToBucketPrefix(req.GetVolumeId())
+	volContext := req.GetVolumeContext()
+	if _, idContext := splitVolumeID(req.GetVolumeId()); idContext != nil {
+		volContext = idContext
+	}
 
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
+	client, err := s3.NewClientFromSecret(ctx, volumeSecrets(req.GetSecrets(), volContext))
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
 	}
@@ -249,6 +292,7 @@ func sanitizeVolumeID(volumeID string) string {
 // volumeIDToBucketPrefix returns the bucket name and prefix based on the volumeID.
 // Prefix is empty if volumeID does not have a slash in the name.
 func volumeIDToBucketPrefix(volumeID string) (string, string) {
+	volumeID, _ = splitVolumeID(volumeID)
 	// if the volumeID has a slash in it, this volume is
 	// stored under a certain prefix within the bucket.
 	splitVolumeID := strings.SplitN(volumeID, "/", 2)
@@ -0,0 +1,114 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// credentialsHash identifies S3 credentials in the secrets without keeping them, empty if there are none
+func credentialsHash(secrets map[string]string) string {
+	if secrets["accessKeyID"] == "" && secrets["secretAccessKey"] == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(secrets["accessKeyID"] + "\x00" + secrets["secretAccessKey"]))
+	return hex.EncodeToString(hash[:])
+}
+
+// rotationMounts returns FUSE mounts of the volume if it's mounted with credentials other than
+// the ones in secrets, and nil if the credentials are the same or unknown
+func (r *volumeRegistry) rotationMounts(stagingPath string, secrets map[string]string) []*monitoredMount {
+	hash := credentialsHash(secrets)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol, ok := r.volumes[stagingPath]
+	if !ok || hash == "" || vol.CredentialsHash == "" || vol.CredentialsHash == hash {
+		return nil
+	}
+	var mounts []*monitoredMount
+	for _, m := range vol.mounts() {
+		m.secrets = secrets
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+// restoredMounts returns FUSE mounts of the volume if its secrets are unknown since the restart of
+// the node plugin, and remembers the secrets. It returns nil if secrets are empty or already known
+func (r *volumeRegistry) restoredMounts(stagingPath string, secrets map[string]string) []*monitoredMount {
+	if len(secrets) == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol, ok := r.volumes[stagingPath]
+	if !ok || len(vol.secrets) > 0 {
+		return nil
+	}
+	vol.secrets = secrets
+	var mounts []*monitoredMount
+	for _, m := range vol.mounts() {
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+// rotateCredentials applies credentials rotated in the secret to running FUSE mounts of a volume.
+// The credentials file of every mount is rewritten in place, which GeeseFS and rclone pick up by
+// themselves. s3fs only reads its passwd_file on startup, so its mounts are restarted, which fails
+// I/O in progress, and their bind mounts into pods are re-established
+func (ns *nodeServer) rotateCredentials(ctx context.Context, volumeID, stagingPath string, secrets map[string]string) error {
+	mounts := ns.volumes.rotationMounts(stagingPath, secrets)
+	if len(mounts) == 0 {
+		return nil
+	}
+	logger := klog.FromContext(ctx)
+	logger.Info("Credentials of the volume have changed, updating its FUSE mounts", "mounts", len(mounts))
+	var errs []error
+	restarted := 0
+	for _, m := range mounts {
+		reloaded, err := updateMountCredentials(ctx, m, secrets)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to update credentials of %v: %v", m.path, err))
+			continue
+		}
+		if reloaded {
+			continue
+		}
+		logger.Info("FUSE daemon doesn't reload credentials, restarting it", "path", m.path)
+		restarted++
+		if err := ns.remount(ctx, m); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remount %v with new credentials: %v", m.path, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		ns.driver.nodeEvent(v1.EventTypeWarning, "CredentialsRotationFailed",
+			"Failed to apply new credentials to volume %v: %v", volumeID, err)
+		return err
+	}
+	ns.driver.nodeEvent(v1.EventTypeNormal, "CredentialsRotated",
+		"New credentials are applied to volume %v, %d of its %d mounts are restarted", volumeID, restarted, len(mounts))
+	return nil
+}
+
+// updateMountCredentials rewrites the credentials file of the mount, it returns false if its FUSE
+// daemon must be restarted to use them
+func updateMountCredentials(ctx context.Context, m *monitoredMount, secrets map[string]string) (bool, error) {
+	client, err := s3.NewClientFromSecret(ctx, volumeSecrets(secrets, m.volumeContext))
+	if err != nil {
+		return false, err
+	}
+	bucketName, prefix := volumeBucketPrefix(m.volumeID, m.volumeContext)
+	meta, err := getMeta(bucketName, prefix, m.volumeContext, client.Config)
+	if err != nil {
+		return false, err
+	}
+	return mounter.UpdateCredentials(meta, client.Config, m.path)
+}
@@ -18,15 +18,27 @@ package driver
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"net"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/glog"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/metrics"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
 )
 
 type driver struct {
@@ -34,40 +46,169 @@ type driver struct {
 	version  string
 	nodeID   string
 	endpoint string
+	config   *Config
 
 	ids *identityServer
 	ns  *nodeServer
 	cs  *controllerServer
+
+	kube     kubernetes.Interface
+	recorder record.EventRecorder
+	// logger is the base logger of the driver, requests log with its descendants from their context
+	logger klog.Logger
+}
+
+// Config holds optional settings of the driver
+type Config struct {
+	// Mode selects the readiness checks and the background work of the driver, one of ModeAll,
+	// ModeController and ModeNode. All CSI services are served in any mode
+	Mode string
+	// MountCheckInterval is the interval of FUSE mount health checks, 0 disables them
+	MountCheckInterval time.Duration
+	// StateFile keeps the list of staged volumes to restore their mounts after a restart, empty disables it
+	StateFile string
+	// MaxConcurrentMounts limits FUSE daemons starting at the same time on the node, 0 means unlimited
+	MaxConcurrentMounts int
+	// MounterPods runs FUSE daemons in dedicated pods on the node instead of systemd units
+	MounterPods bool
+	// MounterPodNamespace is the namespace of mounter pods
+	MounterPodNamespace string
+	// MounterPodImage is the image of mounter pods, it must contain the FUSE daemons
+	MounterPodImage string
+	// EphemeralPodOptions allows pod authors to set the mounter, its options, limits and cache
+	// of ephemeral volumes in the pod spec. Otherwise such volumes are rejected
+	EphemeralPodOptions bool
+	// MetricsAddress is the address to serve Prometheus metrics on, empty disables them
+	MetricsAddress string
+	// HealthAddress is the address to serve /healthz and /readyz on, empty disables them
+	HealthAddress string
+	// TracingEndpoint is host:port of the OTLP gRPC receiver to export spans to, empty disables tracing
+	TracingEndpoint string
+	// TracingInsecure disables TLS of the connection to the OTLP receiver
+	TracingInsecure bool
+	// TracingSampleRatio is the share of traces started by the driver which are exported
+	TracingSampleRatio float64
 }
 
+// Modes of the driver
+const (
+	// ModeAll runs the controller and the node plugin in one process
+	ModeAll = "all"
+	// ModeController runs the controller, which doesn't mount volumes
+	ModeController = "controller"
+	// ModeNode runs the node plugin, which needs FUSE daemons and restores their mounts
+	ModeNode = "node"
+)
+
 var (
 	vendorVersion = "v1.34.7"
 	driverName    = "ru.yandex.s3.csi"
 )
 
+// DefaultConfig returns the configuration used when none is given to New
+func DefaultConfig() *Config {
+	return &Config{
+		Mode:                ModeAll,
+		MountCheckInterval:  30 * time.Second,
+		StateFile:           "/csi/volumes.json",
+		MounterPodNamespace: "kube-system",
+		TracingSampleRatio:  1,
+	}
+}
+
 // New initializes the driver
-func New(nodeID string, endpoint string) (*driver, error) {
+func New(nodeID string, endpoint string, config *Config) (*driver, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	switch config.Mode {
+	case ModeAll, ModeController, ModeNode:
+	default:
+		return nil, fmt.Errorf("unknown mode %q, must be %s, %s or %s", config.Mode, ModeAll, ModeController, ModeNode)
+	}
 	d := &driver{
 		name:     driverName,
 		version:  vendorVersion,
 		nodeID:   nodeID,
 		endpoint: endpoint,
+		config:   config,
+		logger:   klog.Background().WithValues("nodeID", nodeID),
 	}
 	return d, nil
 }
 
 func (d *driver) Run() {
-	glog.Infof("Driver: %v ", d.name)
-	glog.Infof("Version: %v ", d.version)
+	logger := d.logger
+	logger.Info("Starting driver", "driver", d.name, "version", d.version)
+
+	if d.config.TracingEndpoint != "" {
+		_, err := tracing.Setup(context.Background(), tracing.Config{
+			Endpoint:       d.config.TracingEndpoint,
+			Insecure:       d.config.TracingInsecure,
+			SampleRatio:    d.config.TracingSampleRatio,
+			ServiceVersion: d.version,
+			NodeID:         d.nodeID,
+		})
+		if err != nil {
+			logger.Error(err, "Failed to set up tracing")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		logger.Info("Exporting traces", "endpoint", d.config.TracingEndpoint)
+	}
+
+	d.kube = newKubeClient()
+	if d.kube != nil {
+		d.recorder = newEventRecorder(d.kube, d.nodeID)
+	}
+	if d.config.MounterPods {
+		if d.kube == nil {
+			logger.Error(nil, "Mounter pods require access to the Kubernetes API")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		mounter.Pods = &mounter.PodConfig{
+			Client:    d.kube,
+			Namespace: d.config.MounterPodNamespace,
+			Image:     d.config.MounterPodImage,
+			NodeName:  d.nodeID,
+		}
+	}
 
 	d.ids = &identityServer{driver: d}
-	d.ns = &nodeServer{driver: d}
-	d.cs = &controllerServer{driver: d}
+	d.ns = &nodeServer{
+		driver:   d,
+		volumes:  newVolumeRegistry(d.config.StateFile),
+		inFlight: newInFlight(),
+		targets:  newInFlight(),
+		mounts:   newMountLimiter(d.config.MaxConcurrentMounts),
+	}
+	d.cs = &controllerServer{driver: d, inFlight: newInFlight()}
+
+	if d.config.Mode != ModeController {
+		if err := mounter.CheckDefaultLimits(context.Background()); err != nil {
+			logger.Error(err, "Default limits of FUSE daemons can't be applied")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+		// The state must be loaded before kubelet is able to stage and publish volumes again
+		d.ns.restoreMounts()
+
+		if d.config.MountCheckInterval > 0 {
+			go d.ns.monitorMounts(d.config.MountCheckInterval)
+		}
+	}
+
+	if d.config.MetricsAddress != "" {
+		d.ns.registerMetrics()
+		go metrics.Serve(d.config.MetricsAddress)
+	}
+	if d.config.HealthAddress != "" {
+		go d.serveHealth(d.config.HealthAddress)
+	}
 
 	// Parse endpoint
 	u, err := url.Parse(d.endpoint)
 	if err != nil {
-		glog.Fatalf("Failed to parse endpoint %s: %v", d.endpoint, err)
+		logger.Error(err, "Failed to parse endpoint", "endpoint", d.endpoint)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
 	var addr string
@@ -75,20 +216,24 @@ func (d *driver) Run() {
 	case "unix":
 		addr = u.Path
 		if err := os.MkdirAll(path.Dir(addr), 0750); err != nil {
-			glog.Fatalf("Failed to create directory for socket: %v", err)
+			logger.Error(err, "Failed to create directory for socket")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 		}
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			glog.Fatalf("Failed to remove existing socket: %v", err)
+			logger.Error(err, "Failed to remove existing socket")
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 		}
 	case "tcp":
 		addr = u.Host
 	default:
-		glog.Fatalf("Unsupported protocol: %s", u.Scheme)
+		logger.Error(nil, "Unsupported protocol", "scheme", u.Scheme)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
 	listener, err := net.Listen(u.Scheme, addr)
 	if err != nil {
-		glog.Fatalf("Failed to listen on %s: %v", addr, err)
+		logger.Error(err, "Failed to listen", "address", addr)
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 
 	// Ensure socket file is cleaned up on exit
@@ -100,7 +245,8 @@ func (d *driver) Run() {
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		// Spans are started first, so that the logger gets the trace ID and spans get redacted errors
+		grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor, d.withRequestLogger, logGRPC, metrics.UnaryServerInterceptor),
 	}
 	server := grpc.NewServer(opts...)
 
@@ -108,21 +254,52 @@ func (d *driver) Run() {
 	csi.RegisterControllerServer(server, d.cs)
 	csi.RegisterNodeServer(server, d.ns)
 
-	glog.Infof("Listening for connections on address: %#v", listener.Addr())
+	logger.Info("Listening for connections", "address", listener.Addr().String())
 	if err := server.Serve(listener); err != nil {
-		glog.Fatalf("Failed to serve: %v", err)
+		logger.Error(err, "Failed to serve")
+		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+	}
+}
+
+// withRequestLogger puts a logger with a unique request ID, the method and the volume of the call into
+// its context, so that everything logged while serving the call can be tied to it
+func (d *driver) withRequestLogger(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	logger := d.logger.WithValues("requestID", newRequestID(), "method", path.Base(info.FullMethod))
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		logger = logger.WithValues("volumeID", r.GetVolumeId())
 	}
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		logger = logger.WithValues("traceID", span.TraceID().String())
+	}
+	return handler(klog.NewContext(ctx, logger), req)
+}
+
+// newRequestID returns a random ID of a gRPC call
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
 
-// logGRPC logs all gRPC calls
+// logGRPC logs all gRPC calls without their secrets and removes secrets from returned errors
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	glog.V(3).Infof("GRPC call: %s", info.FullMethod)
-	glog.V(5).Infof("GRPC request: %+v", req)
+	logger := klog.FromContext(ctx)
+	logger.V(3).Info("GRPC call", "fullMethod", info.FullMethod)
+	logger.V(5).Info("GRPC request", "request", sanitized{req})
 	resp, err := handler(ctx, req)
 	if err != nil {
-		glog.Errorf("GRPC error: %v", err)
+		err = redactError(err, secretValues(req))
+		switch status.Code(err) {
+		case codes.Unimplemented:
+			logger.V(4).Info("GRPC call is not implemented")
+		case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.FailedPrecondition, codes.OutOfRange:
+			// The caller is wrong, the driver works as expected
+			logger.Info("GRPC call rejected", "code", status.Code(err), "err", err)
+		default:
+			logger.Error(err, "GRPC call failed", "code", status.Code(err))
+		}
 	} else {
-		glog.V(5).Infof("GRPC response: %+v", resp)
+		logger.V(5).Info("GRPC response", "response", sanitized{resp})
 	}
 	return resp, err
 }
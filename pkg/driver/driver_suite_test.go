@@ -4,19 +4,29 @@ import (
 	"log"
 	"os"
 
-	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/driver"
 
-	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
 )
 
-// Ensure IDGen is initialized for all test configs
-func initSanityConfig(cfg *sanity.Config) *sanity.Config {
-	if cfg.IDGen == nil {
-		cfg.IDGen = &sanity.DefaultIDGenerator{}
-	}
-	return cfg
+// testConfig disables the state file, so tests don't write outside of temporary directories
+func testConfig() *driver.Config {
+	config := driver.DefaultConfig()
+	config.StateFile = ""
+	return config
+}
+
+// sanityConfig returns the default sanity config with paths, the endpoint and parameters of the test
+func sanityConfig(targetPath, stagingPath, address string, parameters map[string]string) *sanity.TestConfig {
+	cfg := sanity.NewTestConfig()
+	cfg.TargetPath = targetPath
+	cfg.StagingPath = stagingPath
+	cfg.Address = address
+	cfg.SecretsFile = "../../test/secret.yaml"
+	cfg.TestVolumeParameters = parameters
+	return &cfg
 }
 
 var _ = Describe("S3Driver", func() {
@@ -27,22 +37,16 @@ var _ = Describe("S3Driver", func() {
 		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 			Expect(err).NotTo(HaveOccurred())
 		}
-		driver, err := driver.New("test-node", csiEndpoint)
+		driver, err := driver.New("test-node", csiEndpoint, testConfig())
 		if err != nil {
 			log.Fatal(err)
 		}
 		go driver.Run()
 
 		Describe("CSI sanity", func() {
-			sanityCfg := initSanityConfig(&sanity.Config{
-				TargetPath:  os.TempDir() + "/geesefs-target",
-				StagingPath: os.TempDir() + "/geesefs-staging",
-				Address:     csiEndpoint,
-				SecretsFile: "../../test/secret.yaml",
-				TestVolumeParameters: map[string]string{
-					"mounter": "geesefs",
-					"bucket":  "testbucket0",
-				},
+			sanityCfg := sanityConfig(os.TempDir()+"/geesefs-target", os.TempDir()+"/geesefs-staging", csiEndpoint, map[string]string{
+				"mounter": "geesefs",
+				"bucket":  "testbucket0",
 			})
 			sanity.GinkgoTest(sanityCfg)
 		})
@@ -54,21 +58,15 @@ var _ = Describe("S3Driver", func() {
 		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 			Expect(err).NotTo(HaveOccurred())
 		}
-		driver, err := driver.New("test-node", csiEndpoint)
+		driver, err := driver.New("test-node", csiEndpoint, testConfig())
 		if err != nil {
 			log.Fatal(err)
 		}
 		go driver.Run()
 
 		Describe("CSI sanity", func() {
-			sanityCfg := initSanityConfig(&sanity.Config{
-				TargetPath:  os.TempDir() + "/geesefs-no-bucket-target",
-				StagingPath: os.TempDir() + "/geesefs-no-bucket-staging",
-				Address:     csiEndpoint,
-				SecretsFile: "../../test/secret.yaml",
-				TestVolumeParameters: map[string]string{
-					"mounter": "geesefs",
-				},
+			sanityCfg := sanityConfig(os.TempDir()+"/geesefs-no-bucket-target", os.TempDir()+"/geesefs-no-bucket-staging", csiEndpoint, map[string]string{
+				"mounter": "geesefs",
 			})
 			sanity.GinkgoTest(sanityCfg)
 		})
@@ -81,23 +79,17 @@ var _ = Describe("S3Driver", func() {
 			if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 				Expect(err).NotTo(HaveOccurred())
 			}
-			driver, err := driver.New("test-node", csiEndpoint)
+			driver, err := driver.New("test-node", csiEndpoint, testConfig())
 			if err != nil {
 				log.Fatal(err)
 			}
 			go driver.Run()
 
 			Describe("CSI sanity", func() {
-				sanityCfg := &sanity.Config{
-					TargetPath:  os.TempDir() + "/s3fs-target",
-					StagingPath: os.TempDir() + "/s3fs-staging",
-					Address:     csiEndpoint,
-					SecretsFile: "../../test/secret.yaml",
-					TestVolumeParameters: map[string]string{
+				sanityCfg := sanityConfig(os.TempDir() + "/s3fs-target", os.TempDir() + "/s3fs-staging", csiEndpoint, map[string]string{
 						"mounter": "s3fs",
 						"bucket":  "testbucket1",
-					},
-				}
+					})
 				sanity.GinkgoTest(sanityCfg)
 			})
 		})
@@ -109,23 +101,17 @@ var _ = Describe("S3Driver", func() {
 			if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
 				Expect(err).NotTo(HaveOccurred())
 			}
-			driver, err := driver.New("test-node", csiEndpoint)
+			driver, err := driver.New("test-node", csiEndpoint, testConfig())
 			if err != nil {
 				log.Fatal(err)
 			}
 			go driver.Run()
 
 			Describe("CSI sanity", func() {
-				sanityCfg := &sanity.Config{
-					TargetPath:  os.TempDir() + "/rclone-target",
-					StagingPath: os.TempDir() + "/rclone-staging",
-					Address:     csiEndpoint,
-					SecretsFile: "../../test/secret.yaml",
-					TestVolumeParameters: map[string]string{
+				sanityCfg := sanityConfig(os.TempDir() + "/rclone-target", os.TempDir() + "/rclone-staging", csiEndpoint, map[string]string{
 						"mounter": "rclone",
 						"bucket":  "testbucket3",
-					},
-				}
+					})
 				sanity.GinkgoTest(sanityCfg)
 			})
 		})
@@ -0,0 +1,165 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// Ephemeral inline volumes are declared in the pod spec. They are not staged, instead the FUSE
+// daemon is mounted directly in the target path by NodePublishVolume and unmounted by NodeUnpublishVolume
+
+// podControlledAttributes change how the FUSE daemon of an ephemeral volume runs on the node. Pod authors
+// set them instead of cluster administrators, so they are only accepted with --ephemeral-pod-options
+var podControlledAttributes = []string{
+	mounter.TypeKey, mounter.OptionsKey, mounter.MemoryLimitKey, mounter.CPULimitKey, mounter.CacheSizeKey, mounter.CacheModeKey,
+}
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralKey] == "true"
+}
+
+func hasTempPrefix(volumeContext map[string]string) bool {
+	temp, _ := strconv.ParseBool(volumeContext[mounter.TempPrefixKey])
+	return temp
+}
+
+// volumeBucketPrefix returns the bucket and the prefix mounted for the volume. Ephemeral volumes
+// take them from volume attributes, as their IDs are generated by kubelet
+func volumeBucketPrefix(volumeID string, volumeContext map[string]string) (string, string) {
+	if !isEphemeral(volumeContext) {
+		return volumeIDToBucketPrefix(volumeID)
+	}
+	prefix := strings.Trim(volumeContext[mounter.PrefixKey], "/")
+	if hasTempPrefix(volumeContext) {
+		prefix = path.Join(prefix, volumeID)
+	}
+	return volumeContext[mounter.BucketKey], prefix
+}
+
+func (ns *nodeServer) publishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	volumeContext := req.GetVolumeContext()
+
+	bucketName, prefix := volumeBucketPrefix(volumeID, volumeContext)
+	if bucketName == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Ephemeral volumes require the %s attribute", mounter.BucketKey)
+	}
+	if temp := volumeContext[mounter.TempPrefixKey]; temp != "" {
+		if _, err := strconv.ParseBool(temp); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s %q", mounter.TempPrefixKey, temp)
+		}
+	}
+	if !ns.driver.config.EphemeralPodOptions {
+		for _, key := range podControlledAttributes {
+			if volumeContext[key] != "" {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"%s of ephemeral volumes can't be set in the pod spec, the node plugin runs without --ephemeral-pod-options", key)
+			}
+		}
+	}
+	mountGroup := req.GetVolumeCapability().GetMount().GetVolumeMountGroup()
+	if err := validateMountGroup(mountGroup); err != nil {
+		return nil, err
+	}
+	readOnly := req.GetReadonly() || isReadOnlyCapability(req.GetVolumeCapability())
+
+	if err := ns.restoreWithSecrets(ctx, targetPath, req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	notMnt, err := checkMount(targetPath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		if err := ns.rotateCredentials(ctx, volumeID, targetPath, req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		ns.volumes.add(volumeID, targetPath, readOnly, mountGroup, volumeContext, req.GetSecrets())
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if hasTempPrefix(volumeContext) {
+		client, err := s3.NewClientFromSecret(ctx, req.GetSecrets())
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+		}
+		if err = client.CreatePrefix(bucketName, prefix); err != nil {
+			return nil, fmt.Errorf("failed to create prefix %s: %v", prefix, err)
+		}
+	}
+
+	logger.V(3).Info("Mounting ephemeral volume", "target", targetPath)
+	err = ns.mountVolume(ctx, volumeID, targetPath, mountGroup, readOnly, volumeContext, req.GetSecrets())
+	if err != nil {
+		if hasTempPrefix(volumeContext) {
+			removeTempPrefix(ctx, volumeID, volumeContext, req.GetSecrets())
+		}
+		return nil, err
+	}
+	ns.volumes.add(volumeID, targetPath, readOnly, mountGroup, volumeContext, req.GetSecrets())
+
+	logger.V(4).Info("Ephemeral volume is published", "target", targetPath)
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (ns *nodeServer) unpublishEphemeralVolume(ctx context.Context, vol *stagedVolume) (*csi.NodeUnpublishVolumeResponse, error) {
+	secrets := ns.volumes.volumeSecrets(vol.StagingPath)
+	logger := klog.FromContext(ctx).WithValues("mounter", volumeMounterType(vol))
+	ctx = klog.NewContext(ctx, logger)
+
+	// Forget the volume first so the mount monitor doesn't try to revive it
+	ns.volumes.remove(vol.StagingPath)
+	if err := unmountStaged(ctx, vol.VolumeID, vol.StagingPath, volumeMounterType(vol)); err != nil {
+		return nil, err
+	}
+	logger.V(4).Info("Ephemeral volume is unpublished", "target", vol.StagingPath)
+
+	if hasTempPrefix(vol.VolumeContext) {
+		if len(secrets) == 0 && vol.Pod != nil {
+			var err error
+			lookupCtx, cancel := context.WithTimeout(ctx, mountCheckTimeout)
+			secrets, err = ns.driver.getPodVolumeSecrets(lookupCtx, vol.Pod)
+			cancel()
+			if err != nil {
+				logger.Error(err, "Failed to get secrets of ephemeral volume")
+			}
+		}
+		if err := removeTempPrefix(ctx, vol.VolumeID, vol.VolumeContext, secrets); err != nil {
+			// The pod is already gone, so the prefix is left behind instead of blocking its removal
+			ns.driver.nodeEvent(v1.EventTypeWarning, "TempPrefixNotRemoved",
+				"Failed to remove the temporary prefix of ephemeral volume %v: %v", vol.VolumeID, err)
+		}
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// removeTempPrefix deletes the prefix created for the lifetime of an ephemeral volume
+func removeTempPrefix(ctx context.Context, volumeID string, volumeContext, secrets map[string]string) error {
+	logger := klog.FromContext(ctx)
+	bucketName, prefix := volumeBucketPrefix(volumeID, volumeContext)
+	client, err := s3.NewClientFromSecret(ctx, secrets)
+	if err == nil {
+		err = client.RemovePrefix(bucketName, prefix)
+	}
+	if err != nil {
+		logger.Error(err, "Failed to remove temporary prefix", "bucket", bucketName, "prefix", prefix)
+		return err
+	}
+	logger.V(4).Info("Temporary prefix is removed", "bucket", bucketName, "prefix", prefix)
+	return nil
+}
@@ -0,0 +1,212 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+	"k8s.io/klog/v2"
+)
+
+// maxEventOutput limits the output of the FUSE daemon included in an event
+const maxEventOutput = 1024
+
+func newEventRecorder(client kubernetes.Interface, nodeID string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName, Host: nodeID})
+}
+
+// nodeEvent posts an event about the node the driver runs on
+func (d *driver) nodeEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if d.recorder == nil || d.nodeID == "" {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind: "Node",
+		Name: d.nodeID,
+		// Node events are conventionally bound to the node name
+		UID: types.UID(d.nodeID),
+	}
+	d.recorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
+
+// failureCategory is a class of mount and provisioning failures, named by the reason of their events
+type failureCategory struct {
+	reason string
+	// hint tells the user how to fix the failure
+	hint string
+}
+
+var (
+	failureBadCredentials = failureCategory{"BadCredentials",
+		"Check accessKeyID and secretAccessKey in the secret of the volume and permissions of the key to the bucket"}
+	failureBucketNotFound = failureCategory{"BucketNotFound",
+		"Check that the bucket exists at the endpoint and in the region of the secret of the volume"}
+	failureDaemonFailed = failureCategory{"FUSEDaemonFailed",
+		"The FUSE daemon has exited without mounting the volume, check its output and the options of the storage class"}
+	failureMountTimeout = failureCategory{"MountTimeout",
+		"The FUSE daemon has not mounted the volume in time, check that the S3 endpoint is reachable from the node"}
+	failureSystemdUnavailable = failureCategory{"SystemdUnavailable",
+		"The FUSE daemon can't be started by systemd on the host, check access of the node plugin to the systemd D-Bus socket " +
+			"or add --no-systemd to options of the storage class to run the daemon in the plugin container"}
+	failureMount = failureCategory{"MountFailed",
+		"Check the logs of the node plugin of the driver"}
+)
+
+// Fragments of S3 errors and FUSE daemon output, compared in lower case
+var (
+	badCredentialsErrors = []string{
+		"invalidaccesskeyid", "access key id you provided does not exist",
+		"signaturedoesnotmatch", "signature we calculated does not match",
+		"accessdenied", "access denied", "403 forbidden", "invalid credentials",
+		"could not determine how to establish security credentials",
+	}
+	bucketNotFoundErrors = []string{
+		"nosuchbucket", "bucket does not exist", "bucket not found",
+	}
+)
+
+// classifyFailure returns the category of a failure from its error and the output of the FUSE daemon.
+// S3 errors are recognized first as they often make the daemon exit or never mount. It returns
+// fallback if the failure is unknown
+func classifyFailure(err error, output string, fallback failureCategory) failureCategory {
+	text := strings.ToLower(err.Error() + "\n" + output)
+	containsAny := func(fragments []string) bool {
+		for _, f := range fragments {
+			if strings.Contains(text, f) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case containsAny(badCredentialsErrors):
+		return failureBadCredentials
+	case containsAny(bucketNotFoundErrors):
+		return failureBucketNotFound
+	case errors.Is(err, mounter.ErrSystemdUnavailable):
+		return failureSystemdUnavailable
+	case errors.Is(err, mounter.ErrMountTimeout):
+		return failureMountTimeout
+	case errors.Is(err, mounter.ErrDaemonFailed):
+		return failureDaemonFailed
+	}
+	return fallback
+}
+
+// volumeObjects are Kubernetes objects of a volume events about its failures are posted to,
+// names of unknown objects are empty
+type volumeObjects struct {
+	pvName       string
+	pvcName      string
+	pvcNamespace string
+	podName      string
+	podNamespace string
+}
+
+// volumeContextObjects returns objects of the volume known from its volume context. PV and PVC names
+// are added by external-provisioner with --extra-create-metadata and pod names by kubelet on publish
+func volumeContextObjects(volumeContext map[string]string) volumeObjects {
+	return volumeObjects{
+		pvName:       volumeContext[pvNameKey],
+		pvcName:      volumeContext[pvcNameKey],
+		pvcNamespace: volumeContext[pvcNamespaceKey],
+		podName:      volumeContext[podNameKey],
+		podNamespace: volumeContext[podNamespaceKey],
+	}
+}
+
+// references returns references to the objects for events. Objects are read from the API to bind
+// events to their UIDs, without which kubectl describe doesn't show them
+func (d *driver) references(ctx context.Context, objs volumeObjects) []*v1.ObjectReference {
+	logger := klog.FromContext(ctx)
+	core := d.kube.CoreV1()
+	var refs []*v1.ObjectReference
+	add := func(obj runtime.Object, err error, kind, namespace, name string) {
+		if err == nil {
+			if ref, err := reference.GetReference(scheme.Scheme, obj); err == nil {
+				refs = append(refs, ref)
+				return
+			}
+		}
+		logger.V(4).Info("Failed to get the object of the volume, posting the event without its UID",
+			"kind", kind, "object", klog.KRef(namespace, name), "err", err)
+		refs = append(refs, &v1.ObjectReference{APIVersion: "v1", Kind: kind, Namespace: namespace, Name: name})
+	}
+	if objs.pvName != "" {
+		pv, err := core.PersistentVolumes().Get(ctx, objs.pvName, metav1.GetOptions{})
+		add(pv, err, "PersistentVolume", "", objs.pvName)
+	}
+	if objs.pvcName != "" {
+		pvc, err := core.PersistentVolumeClaims(objs.pvcNamespace).Get(ctx, objs.pvcName, metav1.GetOptions{})
+		add(pvc, err, "PersistentVolumeClaim", objs.pvcNamespace, objs.pvcName)
+	}
+	if objs.podName != "" {
+		pod, err := core.Pods(objs.podNamespace).Get(ctx, objs.podName, metav1.GetOptions{})
+		add(pod, err, "Pod", objs.podNamespace, objs.podName)
+	}
+	return refs
+}
+
+// failureEvent posts a warning event about a failure of the volume to its objects in the background.
+// Credentials in secrets are removed from the message, output is the tail of the FUSE daemon's stderr
+func (d *driver) failureEvent(ctx context.Context, objs volumeObjects, category failureCategory,
+	message string, output string, secrets map[string]string) {
+	if d.recorder == nil || objs == (volumeObjects{}) {
+		return
+	}
+	message += ". " + category.hint
+	if output != "" {
+		if len(output) > maxEventOutput {
+			output = "..." + output[len(output)-maxEventOutput:]
+		}
+		message += "\nOutput of the FUSE daemon:\n" + output
+	}
+	for k, v := range secrets {
+		if v != "" && mounter.IsSecretOption(k) {
+			message = strings.ReplaceAll(message, v, mounter.Redacted)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+	go func() {
+		defer cancel()
+		for _, ref := range d.references(ctx, objs) {
+			d.recorder.Event(ref, v1.EventTypeWarning, category.reason, message)
+		}
+	}()
+}
+
+// mountFailureEvent explains a failed mount of the volume in the target path in events
+func (d *driver) mountFailureEvent(ctx context.Context, volumeID, target string, volumeContext, secrets map[string]string, err error) {
+	if d.recorder == nil {
+		return
+	}
+	output := mounter.StderrTail(target)
+	category := classifyFailure(err, output, failureMount)
+	d.failureEvent(ctx, volumeContextObjects(volumeContext), category,
+		fmt.Sprintf("Failed to mount volume %v on node %v: %v", volumeID, d.nodeID, err), output, secrets)
+}
+
+// provisioningFailureEvent explains a failed creation of the volume in events of its PVC. Failures
+// of unknown categories are reported by external-provisioner itself
+func (d *driver) provisioningFailureEvent(ctx context.Context, volumeID string, params, secrets map[string]string, err error) {
+	category := classifyFailure(err, "", failureCategory{})
+	if category.reason == "" {
+		return
+	}
+	objs := volumeObjects{pvcName: params[pvcNameKey], pvcNamespace: params[pvcNamespaceKey]}
+	d.failureEvent(ctx, objs, category, fmt.Sprintf("Failed to create volume %v: %v", volumeID, err), "", secrets)
+}
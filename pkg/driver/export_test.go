@@ -0,0 +1,4 @@
+package driver
+
+// LogGRPC exposes the logging interceptor to tests of the driver_test package
+var LogGRPC = logGRPC
@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+)
+
+// checkReady returns the reasons why the driver can't serve volumes in its mode, or nil if it's ready
+func (d *driver) checkReady(ctx context.Context) []string {
+	if d.config.Mode == ModeController {
+		// the controller only needs S3, which is checked with credentials of every volume
+		return nil
+	}
+	return mounter.CheckReady(ctx)
+}
+
+// serveHealth serves /healthz, which succeeds while the driver is running, and /readyz, which fails
+// with the reasons reported by Probe when it's not ready, until the process exits
+func (d *driver) serveHealth(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		reasons := d.checkReady(r.Context())
+		if len(reasons) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			for _, reason := range reasons {
+				fmt.Fprintln(w, reason)
+			}
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	d.logger.Info("Serving health checks", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		d.logger.Error(err, "Failed to serve health checks", "address", address)
+	}
+}
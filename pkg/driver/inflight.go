@@ -0,0 +1,106 @@
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// inFlight tracks volumes or target paths with operations in progress. As the CSI spec recommends,
+// a concurrent operation on the same volume is rejected with Aborted and retried by the caller later,
+// instead of racing with the first one between checking and changing mounts or buckets
+type inFlight struct {
+	mu      sync.Mutex
+	volumes map[string]chan struct{}
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{volumes: make(map[string]chan struct{})}
+}
+
+// tryAcquire marks an operation on the volume as in progress, it returns false if one already is
+func (f *inFlight) tryAcquire(volumeID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.volumes[volumeID]; ok {
+		return false
+	}
+	f.volumes[volumeID] = make(chan struct{})
+	return true
+}
+
+// acquire is tryAcquire returning the error for the caller of a CSI call
+func (f *inFlight) acquire(volumeID string) error {
+	if !f.tryAcquire(volumeID) {
+		return status.Errorf(codes.Aborted, "An operation on %v is already in progress", volumeID)
+	}
+	return nil
+}
+
+// wait acquires the volume after the operation in progress on it finishes, for short steps of calls
+// which may run concurrently, like publishing a volume to several targets
+func (f *inFlight) wait(ctx context.Context, volumeID string) error {
+	for {
+		f.mu.Lock()
+		done, ok := f.volumes[volumeID]
+		if !ok {
+			f.volumes[volumeID] = make(chan struct{})
+			f.mu.Unlock()
+			return nil
+		}
+		f.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+func (f *inFlight) release(volumeID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if done, ok := f.volumes[volumeID]; ok {
+		close(done)
+		delete(f.volumes, volumeID)
+	}
+}
+
+func (f *inFlight) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.volumes)
+}
+
+// mountLimiter limits the number of FUSE daemons starting at the same time on the node, so that
+// pods rescheduled to it or restarted after a reboot don't overload the node and the S3 endpoint
+type mountLimiter chan struct{}
+
+// newMountLimiter returns a limiter of max concurrent mounts, nil if they are unlimited
+func newMountLimiter(max int) mountLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return make(mountLimiter, max)
+}
+
+// acquire waits until a mount may be started or the call is cancelled
+func (l mountLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (l mountLimiter) release() {
+	if l != nil {
+		<-l
+	}
+}
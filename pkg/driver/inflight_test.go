@@ -0,0 +1,116 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInFlightAcquire(t *testing.T) {
+	f := newInFlight()
+	if err := f.acquire("vol-1"); err != nil {
+		t.Fatalf("acquire of a free volume failed: %v", err)
+	}
+	if err := f.acquire("vol-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("acquire of a busy volume returned %v, want Aborted", err)
+	}
+	if !f.tryAcquire("vol-2") {
+		t.Error("tryAcquire of another volume failed")
+	}
+	if got := f.count(); got != 2 {
+		t.Errorf("count() = %d, want 2", got)
+	}
+	f.release("vol-1")
+	if !f.tryAcquire("vol-1") {
+		t.Error("tryAcquire of a released volume failed")
+	}
+	// releasing a free volume is a no-op
+	f.release("vol-3")
+	if got := f.count(); got != 2 {
+		t.Errorf("count() = %d, want 2", got)
+	}
+}
+
+func TestInFlightWait(t *testing.T) {
+	f := newInFlight()
+	if err := f.wait(context.Background(), "vol-1"); err != nil {
+		t.Fatalf("wait for a free volume failed: %v", err)
+	}
+	acquired := make(chan error)
+	go func() {
+		acquired <- f.wait(context.Background(), "vol-1")
+	}()
+	select {
+	case err := <-acquired:
+		t.Fatalf("wait returned %v while the volume is busy", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	f.release("vol-1")
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatalf("wait failed after release: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait didn't return after release")
+	}
+	if f.tryAcquire("vol-1") {
+		t.Error("wait didn't acquire the volume")
+	}
+}
+
+func TestInFlightWaitCancelled(t *testing.T) {
+	f := newInFlight()
+	f.tryAcquire("vol-1")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := f.wait(ctx, "vol-1"); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("wait returned %v, want DeadlineExceeded", err)
+	}
+	f.release("vol-1")
+	if !f.tryAcquire("vol-1") {
+		t.Error("cancelled wait left the volume acquired")
+	}
+}
+
+func TestLockTarget(t *testing.T) {
+	ns := &nodeServer{inFlight: newInFlight(), targets: newInFlight()}
+	ctx := context.Background()
+	if err := ns.lockTarget(ctx, "vol-1", "/pods/a"); err != nil {
+		t.Fatalf("lockTarget failed: %v", err)
+	}
+	// the same target is rejected
+	if err := ns.lockTarget(ctx, "vol-1", "/pods/a"); status.Code(err) != codes.Aborted {
+		t.Errorf("lockTarget of a busy target returned %v, want Aborted", err)
+	}
+	// another target of the volume waits instead of failing
+	locked := make(chan error)
+	go func() {
+		locked <- ns.lockTarget(ctx, "vol-1", "/pods/b")
+	}()
+	select {
+	case err := <-locked:
+		t.Fatalf("lockTarget of another target returned %v while the volume is busy", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// staging is rejected while a target is being published
+	if err := ns.inFlight.acquire("vol-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("acquire of the volume returned %v, want Aborted", err)
+	}
+	ns.unlockTarget("vol-1", "/pods/a")
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatalf("lockTarget of another target failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lockTarget of another target didn't return after unlock")
+	}
+	ns.unlockTarget("vol-1", "/pods/b")
+	if ns.inFlight.count() != 0 || ns.targets.count() != 0 {
+		t.Errorf("locks are left after unlock: %d volumes, %d targets", ns.inFlight.count(), ns.targets.count())
+	}
+}
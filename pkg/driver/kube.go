@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Added to CreateVolume parameters by external-provisioner with --extra-create-metadata
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	// Added to the volume context of NodePublishVolume by kubelet with podInfoOnMount
+	podNameKey            = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey       = "csi.storage.k8s.io/pod.namespace"
+	serviceAccountNameKey = "csi.storage.k8s.io/serviceAccount.name"
+	ephemeralKey          = "csi.storage.k8s.io/ephemeral"
+)
+
+// newKubeClient returns a Kubernetes API client if the driver runs inside a cluster, nil otherwise
+func newKubeClient() kubernetes.Interface {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		klog.V(2).InfoS("Not running in a Kubernetes cluster, API access is disabled", "err", err)
+		return nil
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.ErrorS(err, "Failed to create Kubernetes API client")
+		return nil
+	}
+	return client
+}
+
+// getPVSecrets returns the node stage secret of the PersistentVolume
+func (d *driver) getPVSecrets(ctx context.Context, pvName string) (map[string]string, error) {
+	if d.kube == nil {
+		return nil, errors.New("Kubernetes API is not available")
+	}
+	pv, err := d.kube.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PersistentVolume %v: %v", pvName, err)
+	}
+	if pv.Spec.CSI == nil {
+		return nil, fmt.Errorf("PersistentVolume %v is not a CSI volume", pvName)
+	}
+	ref := pv.Spec.CSI.NodeStageSecretRef
+	if ref == nil {
+		ref = pv.Spec.CSI.NodePublishSecretRef
+	}
+	if ref == nil {
+		return nil, fmt.Errorf("PersistentVolume %v has no node stage secret", pvName)
+	}
+	return d.getSecret(ctx, ref.Namespace, ref.Name)
+}
+
+// getPodVolumeSecrets returns the node publish secret of an inline volume of the pod
+func (d *driver) getPodVolumeSecrets(ctx context.Context, podVol *podVolume) (map[string]string, error) {
+	if d.kube == nil {
+		return nil, errors.New("Kubernetes API is not available")
+	}
+	pod, err := d.kube.CoreV1().Pods(podVol.Namespace).Get(ctx, podVol.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pod %v/%v: %v", podVol.Namespace, podVol.Name, err)
+	}
+	for _, vol := range pod.Spec.Volumes {
+		if vol.Name != podVol.Volume || vol.CSI == nil {
+			continue
+		}
+		if vol.CSI.NodePublishSecretRef == nil {
+			return nil, fmt.Errorf("volume %v of pod %v/%v has no node publish secret", podVol.Volume, podVol.Namespace, podVol.Name)
+		}
+		// the secret must be in the namespace of the pod
+		return d.getSecret(ctx, podVol.Namespace, vol.CSI.NodePublishSecretRef.Name)
+	}
+	return nil, fmt.Errorf("pod %v/%v has no CSI volume %v", podVol.Namespace, podVol.Name, podVol.Volume)
+}
+
+func (d *driver) getSecret(ctx context.Context, namespace, name string) (map[string]string, error) {
+	secret, err := d.kube.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsForbidden(err) {
+		// RBAC of the node plugin only allows the secrets listed in the deployment
+		klog.FromContext(ctx).Error(err, "Node plugin is not allowed to read the secret of the volume, "+
+			"add it to restoreSecrets of the Helm chart or grant get access to it", "secret", namespace+"/"+name)
+		return nil, fmt.Errorf("permission denied to get secret %v/%v, the volume is remounted when kubelet publishes it again", namespace, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %v/%v: %v", namespace, name, err)
+	}
+	secrets := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	return secrets, nil
+}
+
+// lookupSecrets fetches secrets of a volume registered before the restart of the node plugin
+// from the Kubernetes API and remembers them
+func (ns *nodeServer) lookupSecrets(ctx context.Context, stagingPath string) (map[string]string, error) {
+	pvName, pod := ns.volumes.secretSource(stagingPath)
+	var secrets map[string]string
+	var err error
+	switch {
+	case pvName != "":
+		secrets, err = ns.driver.getPVSecrets(ctx, pvName)
+	case pod != nil:
+		secrets, err = ns.driver.getPodVolumeSecrets(ctx, pod)
+	default:
+		return nil, errors.New("credentials of the volume are unknown until it's published again")
+	}
+	if err != nil {
+		return nil, err
+	}
+	ns.volumes.setSecrets(stagingPath, secrets)
+	return secrets, nil
+}
+
+// pvNameFromTarget returns the name of the PersistentVolume published in targetPath.
+// kubelet saves it in vol_data.json next to the target directory
+func pvNameFromTarget(targetPath string) string {
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(targetPath), "vol_data.json"))
+	if err != nil {
+		return ""
+	}
+	var volData struct {
+		SpecVolID string `json:"specVolID"`
+	}
+	if err := json.Unmarshal(data, &volData); err != nil {
+		return ""
+	}
+	return volData.SpecVolID
+}
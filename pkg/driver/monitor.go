@@ -0,0 +1,377 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/metrics"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// A FUSE mount not answering for this long is considered hung
+	mountCheckTimeout     = 10 * time.Second
+	remountInitialBackoff = 10 * time.Second
+	remountMaxBackoff     = 5 * time.Minute
+	// Volumes restored after a restart of the node plugin are checked and remounted this many at a time
+	restoreConcurrency = 8
+)
+
+type mountHealth struct {
+	failures    int
+	nextAttempt time.Time
+}
+
+// monitoredMount is a FUSE mount of a staged volume, checked by the monitor
+type monitoredMount struct {
+	volumeID      string
+	stagingPath   string
+	path          string
+	mountGroup    string
+	readOnly      bool
+	volumeContext map[string]string
+	secrets       map[string]string
+	// targets bound to this mount, by target path
+	targets map[string]*publishedTarget
+}
+
+// mounts returns FUSE mounts of the volume, it must be called with the lock of the registry held
+func (vol *stagedVolume) mounts() map[string]*monitoredMount {
+	byPath := make(map[string]*monitoredMount)
+	add := func(path, mountGroup string) *monitoredMount {
+		m, ok := byPath[path]
+		if !ok {
+			m = &monitoredMount{
+				volumeID:      vol.VolumeID,
+				stagingPath:   vol.StagingPath,
+				path:          path,
+				mountGroup:    mountGroup,
+				readOnly:      vol.ReadOnly,
+				volumeContext: vol.VolumeContext,
+				secrets:       vol.secrets,
+				targets:       make(map[string]*publishedTarget),
+			}
+			byPath[path] = m
+		}
+		return m
+	}
+	add(vol.StagingPath, vol.MountGroup)
+	for targetPath, target := range vol.Targets {
+		add(target.SourcePath, target.MountGroup).targets[targetPath] = target
+	}
+	return byPath
+}
+
+// dueMounts returns FUSE mounts of all staged volumes except ones waiting for the next remount attempt
+func (r *volumeRegistry) dueMounts(now time.Time) []*monitoredMount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var mounts []*monitoredMount
+	for _, vol := range r.volumes {
+		for path, m := range vol.mounts() {
+			if h, ok := vol.health[path]; ok && now.Before(h.nextAttempt) {
+				continue
+			}
+			mounts = append(mounts, m)
+		}
+	}
+	return mounts
+}
+
+// recordRemount updates the health of the mount after a remount attempt
+// and returns the number of consecutive failures
+func (r *volumeRegistry) recordRemount(m *monitoredMount, err error) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol, ok := r.volumes[m.stagingPath]
+	if !ok {
+		return 0
+	}
+	if err == nil {
+		delete(vol.health, m.path)
+		if vol.remounts == nil {
+			vol.remounts = make(map[string]int64)
+		}
+		vol.remounts[m.path]++
+		return 0
+	}
+	h, ok := vol.health[m.path]
+	if !ok {
+		h = &mountHealth{}
+		vol.health[m.path] = h
+	}
+	h.failures++
+	backoff := remountInitialBackoff
+	for i := 1; i < h.failures && backoff < remountMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > remountMaxBackoff {
+		backoff = remountMaxBackoff
+	}
+	h.nextAttempt = time.Now().Add(backoff)
+	return h.failures
+}
+
+// contains returns true if the volume is still staged, it may have been unstaged since its mounts were listed
+func (r *volumeRegistry) contains(stagingPath string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.volumes[stagingPath]
+	return ok
+}
+
+// monitorMounts periodically checks FUSE mounts of all staged volumes and remounts dead or hung ones.
+// Without it, a dead mount is only revived by the next NodePublishVolume of the volume
+func (ns *nodeServer) monitorMounts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, m := range ns.volumes.dueMounts(time.Now()) {
+			ns.checkVolumeMount(m)
+		}
+	}
+}
+
+// registerMetrics exports the number of staged volumes and FUSE daemons on the node and their resource usage
+func (ns *nodeServer) registerMetrics() {
+	metrics.RegisterGauge("staged_volumes", "Number of volumes staged on the node.", func() float64 {
+		return float64(ns.volumes.count())
+	})
+	metrics.RegisterGauge("inflight_operations", "Number of volumes with CSI calls or remounts in progress on the node.", func() float64 {
+		return float64(ns.inFlight.count())
+	})
+	metrics.RegisterVolumeDaemons(ns.volumeDaemons)
+	metrics.RegisterGauge("fuse_processes", "Number of FUSE daemons visible to the node plugin.", func() float64 {
+		count, err := mounter.CountFuseProcesses()
+		if err != nil {
+			ns.driver.logger.Error(err, "Failed to count FUSE processes")
+		}
+		return float64(count)
+	})
+}
+
+// restoreMounts re-establishes mounts of volumes staged before the restart of the node plugin.
+// FUSE daemons started without systemd run in the plugin container and die with it.
+// The state is loaded and unstaged volumes are cleaned up before serving requests, while
+// mounts are checked and remounted in background, so that the plugin is registered in time
+func (ns *nodeServer) restoreMounts() {
+	if err := ns.volumes.load(); err != nil {
+		ns.driver.logger.Error(err, "Failed to load the state of staged volumes")
+		return
+	}
+	for _, vol := range ns.volumes.removeStale() {
+		logger := ns.driver.logger.WithValues("volumeID", vol.VolumeID)
+		ctx := klog.NewContext(context.Background(), logger)
+		logger.Info("Volume was unstaged while the driver was not running, cleaning up", "stagingPath", vol.StagingPath)
+		for _, target := range vol.Targets {
+			if target.SourcePath != vol.StagingPath {
+				if err := mounter.ForceUnmount(ctx, vol.VolumeID, target.SourcePath); err != nil {
+					logger.Error(err, "Failed to unmount", "path", target.SourcePath)
+				}
+				mounter.RemoveCredentials(target.SourcePath)
+				mounter.RemoveCache(target.SourcePath)
+				mounter.RemoveCgroup(target.SourcePath)
+				os.Remove(target.SourcePath)
+			}
+		}
+		if err := mounter.ForceUnmount(ctx, vol.VolumeID, vol.StagingPath); err != nil {
+			logger.Error(err, "Failed to unmount", "path", vol.StagingPath)
+		}
+		mounter.RemoveCredentials(vol.StagingPath)
+		mounter.RemoveCache(vol.StagingPath)
+		mounter.RemoveCgroup(vol.StagingPath)
+	}
+	go ns.remountRestored()
+}
+
+// remountRestored checks mounts of restored volumes and remounts broken ones, restoreConcurrency
+// volumes at a time. Mounts of a volume are checked one by one, as checks of volumes with
+// operations in progress are skipped
+func (ns *nodeServer) remountRestored() {
+	byVolume := make(map[string][]*monitoredMount)
+	for _, m := range ns.volumes.dueMounts(time.Now()) {
+		byVolume[m.volumeID] = append(byVolume[m.volumeID], m)
+	}
+	sem := make(chan struct{}, restoreConcurrency)
+	var wg sync.WaitGroup
+	for _, mounts := range byVolume {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			for _, m := range mounts {
+				ns.checkVolumeMount(m)
+			}
+		})
+	}
+	wg.Wait()
+	ns.driver.logger.V(2).Info("Mounts of staged volumes are checked after the restart", "volumes", len(byVolume))
+}
+
+// restoreWithSecrets remounts broken mounts of a volume restored after a restart of the node plugin
+// with secrets kubelet passes when it republishes the volume, before they are looked up in the API
+func (ns *nodeServer) restoreWithSecrets(ctx context.Context, stagingPath string, secrets map[string]string) error {
+	var errs []error
+	for _, m := range ns.volumes.restoredMounts(stagingPath, secrets) {
+		if checkMountHealth(m.path, mountCheckTimeout) == nil {
+			continue
+		}
+		klog.FromContext(ctx).Info("Remounting restored volume with republished secrets", "path", m.path)
+		err := ns.remount(ctx, m)
+		ns.volumes.recordRemount(m, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remount %v: %v", m.path, err))
+			continue
+		}
+		// the volume is mounted with these secrets now, which also ends their rotation
+		ns.volumes.setSecrets(stagingPath, secrets)
+	}
+	return errors.Join(errs...)
+}
+
+func (ns *nodeServer) checkVolumeMount(m *monitoredMount) {
+	healthErr := checkMountHealth(m.path, mountCheckTimeout)
+	if healthErr == nil {
+		return
+	}
+	logger := ns.driver.logger.WithValues("volumeID", m.volumeID, "path", m.path)
+	// A CSI call on the volume may be unstaging or remounting it right now, the mount is checked
+	// again on the next tick
+	if !ns.inFlight.tryAcquire(m.volumeID) {
+		logger.V(4).Info("Operation on the volume is in progress, skipping remount", "err", healthErr)
+		return
+	}
+	defer ns.inFlight.release(m.volumeID)
+	if !ns.volumes.contains(m.stagingPath) {
+		return
+	}
+	logger.Info("FUSE mount is broken, remounting", "err", healthErr)
+	ns.driver.nodeEvent(v1.EventTypeWarning, "FUSEMountBroken",
+		"FUSE mount %v of volume %v is broken: %v", m.path, m.volumeID, healthErr)
+	err := ns.remount(klog.NewContext(context.Background(), logger), m)
+	failures := ns.volumes.recordRemount(m, err)
+	if err != nil {
+		logger.Error(err, "Failed to remount volume", "attempt", failures)
+		ns.driver.nodeEvent(v1.EventTypeWarning, "FUSERemountFailed",
+			"Failed to remount volume %v in %v (attempt %d): %v", m.volumeID, m.path, failures, err)
+		return
+	}
+	if len(m.targets) == 0 {
+		logger.Info("Volume is remounted")
+		ns.driver.nodeEvent(v1.EventTypeNormal, "FUSERemounted", "Volume %v is remounted in %v", m.volumeID, m.path)
+		return
+	}
+	// Containers keep the bind mount of the dead FUSE connection unless they mount the volume
+	// with HostToContainer propagation, which the driver can't tell
+	targets := slices.Sorted(maps.Keys(m.targets))
+	logger.Info("Volume is remounted, pods without HostToContainer mount propagation must be restarted", "targets", targets)
+	ns.driver.nodeEvent(v1.EventTypeWarning, "FUSERemounted",
+		"Volume %v is remounted in %v. Pods using it in %v must be restarted unless they mount it with mountPropagation: HostToContainer",
+		m.volumeID, m.path, strings.Join(targets, ", "))
+}
+
+// remount restarts the FUSE daemon of a broken mount and re-establishes bind mounts of it into pods
+func (ns *nodeServer) remount(ctx context.Context, m *monitoredMount) (err error) {
+	ctx, span := tracing.Start(ctx, "remount", attribute.String("csi.volume_id", m.volumeID), attribute.String("path", m.path))
+	defer func() { tracing.End(span, err) }()
+	secrets := m.secrets
+	if len(secrets) == 0 {
+		// Secrets are lost after a restart of the node plugin
+		var err error
+		lookupCtx, cancel := context.WithTimeout(ctx, mountCheckTimeout)
+		secrets, err = ns.lookupSecrets(lookupCtx, m.stagingPath)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	if err := mounter.ForceUnmount(ctx, m.volumeID, m.path); err != nil {
+		return fmt.Errorf("failed to clean up the broken mount: %v", err)
+	}
+	if err := ns.mountVolume(ctx, m.volumeID, m.path, m.mountGroup, m.readOnly, m.volumeContext, secrets); err != nil {
+		return err
+	}
+	// Bind mounts still reference the old FUSE connection. Running containers only see
+	// the new one if the volume is mounted with HostToContainer mount propagation
+	var errs []error
+	for targetPath, target := range m.targets {
+		if err := mounter.LazyUnmount(targetPath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unmount %v: %v", targetPath, err))
+			continue
+		}
+		source := m.path
+		if target.SubPath != "" {
+			var err error
+			if source, err = prepareSubPath(m.path, target.SubPath); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if err := mount.New("").Mount(source, targetPath, "", target.Options); err != nil {
+			errs = append(errs, fmt.Errorf("failed to bind mount %v to %v: %v", source, targetPath, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var (
+	// errNoResponse is returned by calls on hung FUSE mounts
+	errNoResponse = errors.New("no response")
+
+	// pendingCalls are paths with calls still blocked after their timeout
+	pendingMu    sync.Mutex
+	pendingCalls = make(map[string]bool)
+)
+
+// callWithTimeout runs fn accessing the FUSE mount in path and returns errNoResponse if it doesn't
+// finish in time. Calls on hung mounts block in the kernel until the mount is unmounted, so fn keeps
+// running in background after the timeout and no new call on the path is started until it returns
+func callWithTimeout(path string, timeout time.Duration, fn func() error) error {
+	pendingMu.Lock()
+	if pendingCalls[path] {
+		pendingMu.Unlock()
+		return fmt.Errorf("%w, a previous call is still blocked", errNoResponse)
+	}
+	pendingCalls[path] = true
+	pendingMu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := fn()
+		pendingMu.Lock()
+		delete(pendingCalls, path)
+		pendingMu.Unlock()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w in %v", errNoResponse, timeout)
+	}
+}
+
+// checkMountHealth returns an error if the FUSE mount is not mounted, dead or doesn't respond
+func checkMountHealth(path string, timeout time.Duration) error {
+	return callWithTimeout(path, timeout, func() error {
+		notMnt, err := mount.New("").IsLikelyNotMountPoint(path)
+		if os.IsNotExist(err) {
+			// The directory is removed by kubelet, so the volume is not used anymore
+			return nil
+		} else if err == nil && notMnt {
+			return errors.New("not mounted")
+		}
+		return err
+	})
+}
@@ -18,15 +18,25 @@ package driver
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
+	"syscall"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/metrics"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -36,10 +46,35 @@ import (
 
 type nodeServer struct {
 	csi.UnimplementedNodeServer
-	driver *driver
+	driver   *driver
+	volumes  *volumeRegistry
+	inFlight *inFlight
+	// targets are target paths with publish or unpublish calls in progress
+	targets *inFlight
+	mounts  mountLimiter
 }
 
-func getMeta(bucketName, prefix string, context map[string]string) *s3.FSMeta {
+// statVolume and statfsVolume access the volume path in NodeGetVolumeStats, replaced in tests
+var (
+	statVolume   = os.Stat
+	statfsVolume = syscall.Statfs
+)
+
+// Mount flags which may be applied to the bind mount of a published volume
+var supportedMountFlags = map[string]bool{
+	"ro":          true,
+	"rw":          true,
+	"nosuid":      true,
+	"nodev":       true,
+	"noexec":      true,
+	"noatime":     true,
+	"nodiratime":  true,
+	"relatime":    true,
+	"strictatime": true,
+}
+
+// getMeta parses mount parameters of the volume and checks them against the policy of its mounter
+func getMeta(bucketName, prefix string, context map[string]string, cfg *s3.Config) (*s3.FSMeta, error) {
 	mountOptions := make([]string, 0)
 	mountOptStr := context[mounter.OptionsKey]
 	if mountOptStr != "" {
@@ -55,19 +90,70 @@ func getMeta(bucketName, prefix string, context map[string]string) *s3.FSMeta {
 		}
 	}
 	capacity, _ := strconv.ParseInt(context["capacity"], 10, 64)
-	return &s3.FSMeta{
+	meta := &s3.FSMeta{
 		BucketName:    bucketName,
 		Prefix:        prefix,
 		Mounter:       context[mounter.TypeKey],
 		MountOptions:  mountOptions,
 		CapacityBytes: capacity,
 	}
+	if err := mounter.DefaultPolicy.CheckOptions(mounter.Type(meta, cfg), mountOptions); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid %s: %v", mounter.OptionsKey, err)
+	}
+	if limit := context[mounter.MemoryLimitKey]; limit != "" {
+		q, err := resource.ParseQuantity(limit)
+		if err != nil || q.Sign() < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s %q", mounter.MemoryLimitKey, limit)
+		}
+		meta.MemoryLimit = q.Value()
+	}
+	if limit := context[mounter.CPULimitKey]; limit != "" {
+		q, err := resource.ParseQuantity(limit)
+		if err != nil || q.Sign() < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s %q", mounter.CPULimitKey, limit)
+		}
+		meta.CPULimit = q.MilliValue()
+	}
+	if size := context[mounter.CacheSizeKey]; size != "" {
+		q, err := resource.ParseQuantity(size)
+		if err != nil || q.Sign() < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s %q", mounter.CacheSizeKey, size)
+		}
+		meta.CacheSize = q.Value()
+	}
+	if mode := context[mounter.CacheModeKey]; mode != "" {
+		if !slices.Contains(mounter.CacheModes, mode) {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid %s %q, must be one of %v", mounter.CacheModeKey, mode, mounter.CacheModes)
+		}
+		meta.CacheMode = mode
+	}
+	return meta, nil
+}
+
+// lockTarget serializes publishing and unpublishing of the target path. Pods on the node may publish
+// the same volume at the same time, so calls on other targets of the volume wait for each other instead
+// of failing with Aborted, while stage and unstage calls and remounts reject concurrent operations
+func (ns *nodeServer) lockTarget(ctx context.Context, volumeID, targetPath string) error {
+	if err := ns.targets.acquire(targetPath); err != nil {
+		return err
+	}
+	if err := ns.inFlight.wait(ctx, volumeID); err != nil {
+		ns.targets.release(targetPath)
+		return err
+	}
+	return nil
+}
+
+func (ns *nodeServer) unlockTarget(volumeID, targetPath string) {
+	ns.inFlight.release(volumeID)
+	ns.targets.release(targetPath)
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 	stagingTargetPath := req.GetStagingTargetPath()
+	logger := klog.FromContext(ctx)
 
 	// Check arguments
 	if req.GetVolumeCapability() == nil {
@@ -76,59 +162,106 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
 	}
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	if err := ns.lockTarget(ctx, volumeID, targetPath); err != nil {
+		return nil, err
+	}
+	defer ns.unlockTarget(volumeID, targetPath)
+	if isEphemeral(req.GetVolumeContext()) {
+		return ns.publishEphemeralVolume(ctx, req)
+	}
 	if len(stagingTargetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging Target path missing in request")
 	}
-	if len(targetPath) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+
+	mountGroup := req.GetVolumeCapability().GetMount().GetVolumeMountGroup()
+	if err := validateMountGroup(mountGroup); err != nil {
+		return nil, err
+	}
+	readOnlyMount := isReadOnlyCapability(req.GetVolumeCapability())
+	subPath, err := expandSubPath(req.GetVolumeContext())
+	if err != nil {
+		return nil, err
 	}
 
+	if err := ns.restoreWithSecrets(ctx, stagingTargetPath, req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	notMnt, err := checkMount(stagingTargetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if notMnt {
 		// Staged mount is dead by some reason. Revive it
-		bucketName, prefix := volumeIDToBucketPrefix(volumeID)
-		s3Client, err := s3.NewClientFromSecret(req.GetSecrets())
+		err = ns.mountVolume(ctx, volumeID, stagingTargetPath, mountGroup, readOnlyMount, req.VolumeContext, req.GetSecrets())
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+			return nil, err
 		}
-		meta := getMeta(bucketName, prefix, req.VolumeContext)
-		m, err := mounter.New(meta, s3Client.Config)
+	} else if err := ns.rotateCredentials(ctx, volumeID, stagingTargetPath, req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	stagedGroup := ""
+	if mountGroup != "" && getMountGroup(stagingTargetPath) == mountGroup {
+		stagedGroup = mountGroup
+	}
+	ns.volumes.add(volumeID, stagingTargetPath, readOnlyMount, stagedGroup, req.GetVolumeContext(), req.GetSecrets())
+
+	sourcePath := stagingTargetPath
+	if mountGroup != stagedGroup {
+		// The volume is staged for another group, so it needs a separate FUSE mount
+		sourcePath = groupStagingPath(stagingTargetPath, mountGroup)
+		notMnt, err = checkMount(sourcePath)
 		if err != nil {
-			return nil, err
+			return nil, status.Error(codes.Internal, err.Error())
 		}
-		if err := m.Mount(stagingTargetPath, volumeID); err != nil {
-			return nil, err
+		if notMnt {
+			err = ns.mountVolume(ctx, volumeID, sourcePath, mountGroup, readOnlyMount, req.VolumeContext, req.GetSecrets())
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
+	readOnly := req.GetReadonly()
+	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
+	attrib := req.GetVolumeContext()
+	options := bindMountOptions(logger, readOnly, mountFlags)
+	target := &publishedTarget{
+		SourcePath: sourcePath,
+		MountGroup: mountGroup,
+		SubPath:    subPath,
+		Options:    options,
+	}
+
 	notMnt, err = checkMount(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if !notMnt {
+		ns.volumes.addTarget(stagingTargetPath, targetPath, pvNameFromTarget(targetPath), target)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
-	// TODO: Implement readOnly & mountFlags
-	readOnly := req.GetReadonly()
-	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
-	attrib := req.GetVolumeContext()
-
-	glog.V(4).Infof("target %v\nreadonly %v\nvolumeId %v\nattributes %v\nmountflags %v\n",
-		targetPath, readOnly, volumeID, attrib, mountFlags)
+	logger.V(4).Info("Publishing volume", "target", targetPath, "readOnly", readOnly,
+		"attributes", sanitizedContext(attrib), "mountFlags", mountFlags)
 
-	cmd := exec.Command("mount", "--bind", stagingTargetPath, targetPath)
-	cmd.Stderr = os.Stderr
-	glog.V(3).Infof("Binding volume %v from %v to %v", volumeID, stagingTargetPath, targetPath)
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("Error running mount --bind %v %v: %s", stagingTargetPath, targetPath, out)
+	bindSource := sourcePath
+	if subPath != "" {
+		bindSource, err = prepareSubPath(sourcePath, subPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger.V(3).Info("Binding volume", "source", bindSource, "target", targetPath, "options", options)
+	if err := mount.New("").Mount(bindSource, targetPath, "", options); err != nil {
+		return nil, fmt.Errorf("Error bind mounting %v to %v: %v", bindSource, targetPath, err)
 	}
+	ns.volumes.addTarget(stagingTargetPath, targetPath, pvNameFromTarget(targetPath), target)
 
-	glog.V(4).Infof("s3: volume %s successfully mounted to %s", volumeID, targetPath)
+	logger.V(4).Info("Volume is published", "target", targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -144,11 +277,20 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if err := ns.lockTarget(ctx, volumeID, targetPath); err != nil {
+		return nil, err
+	}
+	defer ns.unlockTarget(volumeID, targetPath)
+
+	if vol := ns.volumes.find(volumeID, targetPath); vol != nil && vol.Ephemeral {
+		return ns.unpublishEphemeralVolume(ctx, vol)
+	}
 
 	if err := mounter.Unmount(targetPath); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	glog.V(4).Infof("s3: volume %s has been unmounted.", volumeID)
+	ns.volumes.removeTarget(volumeID, targetPath)
+	klog.FromContext(ctx).V(4).Info("Volume is unpublished", "target", targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -156,7 +298,6 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	stagingTargetPath := req.GetStagingTargetPath()
-	bucketName, prefix := volumeIDToBucketPrefix(volumeID)
 
 	// Check arguments
 	if len(volumeID) == 0 {
@@ -170,27 +311,28 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume Capability must be provided")
 	}
-
-	notMnt, err := checkMount(stagingTargetPath)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-	if !notMnt {
-		return &csi.NodeStageVolumeResponse{}, nil
+	if err := ns.inFlight.acquire(volumeID); err != nil {
+		return nil, err
 	}
-	client, err := s3.NewClientFromSecret(req.GetSecrets())
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize S3 client: %s", err)
+	defer ns.inFlight.release(volumeID)
+
+	mountGroup := req.GetVolumeCapability().GetMount().GetVolumeMountGroup()
+	if err := validateMountGroup(mountGroup); err != nil {
+		return nil, err
 	}
 
-	meta := getMeta(bucketName, prefix, req.VolumeContext)
-	m, err := mounter.New(meta, client.Config)
+	notMnt, err := checkMount(stagingTargetPath)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.Internal, err.Error())
 	}
-	if err := m.Mount(stagingTargetPath, volumeID); err != nil {
-		return nil, err
+	readOnlyMount := isReadOnlyCapability(req.GetVolumeCapability())
+	if notMnt {
+		err = ns.mountVolume(ctx, volumeID, stagingTargetPath, mountGroup, readOnlyMount, req.VolumeContext, req.GetSecrets())
+		if err != nil {
+			return nil, err
+		}
 	}
+	ns.volumes.add(volumeID, stagingTargetPath, readOnlyMount, mountGroup, req.GetVolumeContext(), req.GetSecrets())
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -206,40 +348,162 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	if len(stagingTargetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
+	if err := ns.inFlight.acquire(volumeID); err != nil {
+		return nil, err
+	}
+	defer ns.inFlight.release(volumeID)
+
+	logger := klog.FromContext(ctx)
 
-	proc, err := mounter.FindFuseMountProcess(stagingTargetPath)
+	// Forget the volume first so the mount monitor doesn't try to revive it
+	mounterType := volumeMounterType(ns.volumes.remove(stagingTargetPath))
+	ctx = klog.NewContext(ctx, logger.WithValues("mounter", mounterType))
+
+	groupDir := groupStagingDir(stagingTargetPath)
+	groupPaths, err := filepath.Glob(filepath.Join(groupDir, groupStagingPrefix+"*"))
 	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	for _, groupPath := range groupPaths {
+		if err := unmountStaged(ctx, volumeID, groupPath, mounterType); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(groupPath); err != nil && !os.IsNotExist(err) {
+			logger.Info("Failed to remove the directory of a per-group mount", "path", groupPath, "err", err)
+		}
+	}
+	if err := os.Remove(groupDir); err != nil && !os.IsNotExist(err) {
+		logger.Info("Failed to remove the directory of per-group mounts", "path", groupDir, "err", err)
+	}
+	if err := unmountStaged(ctx, volumeID, stagingTargetPath, mounterType); err != nil {
 		return nil, err
 	}
+	logger.V(4).Info("Volume is unstaged", "stagingPath", stagingTargetPath)
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// unmountStaged stops the FUSE daemon of a staged mount, either running directly, under systemd or in a mounter pod
+func unmountStaged(ctx context.Context, volumeID, path, mounterType string) (err error) {
+	logger := klog.FromContext(ctx)
+	ctx, span := tracing.Start(ctx, "unmount", attribute.String("mounter", mounterType), attribute.String("path", path))
+	start := time.Now()
+	defer func() {
+		metrics.MountOperation(mounterType, metrics.OperationUnmount, start, err)
+		tracing.End(span, err)
+	}()
+	proc, err := mounter.FindFuseMountProcess(path)
+	if err != nil {
+		return err
+	}
 	exists := false
 	if proc == nil {
-		exists, err = mounter.SystemdUnmount(volumeID)
+		exists, err = mounter.ExternalUnmount(ctx, volumeID, path)
 		if exists && err != nil {
-			return nil, err
+			return err
 		}
 	}
 	if !exists {
-		err = mounter.FuseUnmount(stagingTargetPath)
+		if err := mounter.FuseUnmount(ctx, path); err != nil {
+			logger.Error(err, "Failed to unmount", "path", path)
+		}
 	}
-	glog.V(4).Infof("s3: volume %s has been unmounted from stage path %v.", volumeID, stagingTargetPath)
+	if err := mounter.RemoveCredentials(path); err != nil {
+		logger.Error(err, "Failed to remove credentials of the mount", "path", path)
+	}
+	if err := mounter.RemoveCache(path); err != nil {
+		logger.Error(err, "Failed to remove cache of the mount", "path", path)
+	}
+	if err := mounter.RemoveCgroup(path); err != nil {
+		// the daemon may still be exiting, its cgroup is reused by the next mount of the path
+		logger.V(4).Info("Failed to remove cgroup of the mount", "path", path, "err", err)
+	}
+	return nil
+}
 
-	return &csi.NodeUnstageVolumeResponse{}, nil
+// volumeMounterType returns the mounter of a staged volume for metrics, vol may be nil if it's unknown
+func volumeMounterType(vol *stagedVolume) string {
+	if vol == nil {
+		return "unknown"
+	}
+	return mounter.Type(&s3.FSMeta{Mounter: vol.VolumeContext[mounter.TypeKey]}, &s3.Config{})
+}
+
+// mountVolume starts a FUSE mount of the volume in the target path
+func (ns *nodeServer) mountVolume(ctx context.Context, volumeID, target, mountGroup string, readOnly bool,
+	volumeContext map[string]string, secrets map[string]string) (err error) {
+	defer func() {
+		if err != nil {
+			ns.driver.mountFailureEvent(ctx, volumeID, target, volumeContext, secrets, err)
+		}
+	}()
+	bucketName, prefix := volumeBucketPrefix(volumeID, volumeContext)
+	client, err := s3.NewClientFromSecret(ctx, volumeSecrets(secrets, volumeContext))
+	if err != nil {
+		return fmt.Errorf("failed to initialize S3 client: %s", err)
+	}
+	meta, err := getMeta(bucketName, prefix, volumeContext, client.Config)
+	if err != nil {
+		return err
+	}
+	meta.ReadOnly = readOnly
+	meta.MountGroup = mountGroup
+	m, err := mounter.New(meta, client.Config)
+	if err != nil {
+		return err
+	}
+	mounterType := mounter.Type(meta, client.Config)
+	logger := klog.FromContext(ctx).WithValues("mounter", mounterType)
+	if err := ns.mounts.acquire(ctx); err != nil {
+		return err
+	}
+	defer ns.mounts.release()
+	logger.V(3).Info("Mounting volume", "target", target, "bucket", bucketName, "prefix", prefix)
+	ctx, span := tracing.Start(klog.NewContext(ctx, logger), "mount",
+		attribute.String("mounter", mounterType), attribute.String("path", target))
+	start := time.Now()
+	err = m.Mount(ctx, target, volumeID)
+	metrics.MountOperation(mounterType, metrics.OperationMount, start, err)
+	tracing.End(span, err)
+	if err != nil {
+		// release the cache reservation and don't leave credentials of a failed mount on the node
+		if err := mounter.RemoveCredentials(target); err != nil {
+			logger.Error(err, "Failed to remove credentials of a failed mount", "target", target)
+		}
+		if err := mounter.RemoveCache(target); err != nil {
+			logger.Error(err, "Failed to remove cache of a failed mount", "target", target)
+		}
+		mounter.RemoveCgroup(target)
+	}
+	if errors.Is(err, mounter.ErrCacheBudgetExceeded) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if errors.Is(err, mounter.ErrLimitsUnsupported) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
 }
 
 // NodeGetCapabilities returns the supported capabilities of the node server
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	nscap := &csi.NodeServiceCapability{
-		Type: &csi.NodeServiceCapability_Rpc{
-			Rpc: &csi.NodeServiceCapability_RPC{
-				Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+	var caps []*csi.NodeServiceCapability
+	for _, capType := range []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	} {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: capType,
+				},
 			},
-		},
+		})
 	}
 
 	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			nscap,
-		},
+		Capabilities: caps,
 	}, nil
 }
 
@@ -247,14 +511,182 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 	return &csi.NodeExpandVolumeResponse{}, status.Error(codes.Unimplemented, "NodeExpandVolume is not implemented")
 }
 
+// NodeGetInfo returns the node ID and the region and the zone of the node, so that volumes may be
+// created in S3 endpoints nearest to their nodes
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	topology, err := ns.driver.nodeTopology(ctx)
+	if err != nil {
+		// node-driver-registrar retries failed calls, but never registers the node again after
+		// a successful one, so an empty topology would stick until the plugin restarts
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
 	return &csi.NodeGetInfoResponse{
-		NodeId: ns.driver.nodeID,
+		NodeId:             ns.driver.nodeID,
+		AccessibleTopology: topology,
 	}, nil
 }
 
 func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not implemented")
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+
+	// Check arguments
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	var statfs syscall.Statfs_t
+	var haveStatfs bool
+	err := callWithTimeout(volumePath, mountCheckTimeout, func() error {
+		if _, err := statVolume(volumePath); err != nil {
+			return err
+		}
+		haveStatfs = statfsVolume(volumePath, &statfs) == nil
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume path %v does not exist", volumePath)
+		}
+		if mount.IsCorruptedMnt(err) {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: true,
+					Message:  fmt.Sprintf("FUSE mount of volume %v is dead: %v", volumeID, err),
+				},
+			}, nil
+		}
+		if errors.Is(err, errNoResponse) {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: true,
+					Message:  fmt.Sprintf("FUSE mount of volume %v is hung: %v", volumeID, err),
+				},
+			}, nil
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	var usage []*csi.VolumeUsage
+	if haveStatfs && statfs.Files > 0 {
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		})
+	}
+
+	// FUSE mounters report synthetic free space, so when the capacity of the volume
+	// is known we compare it with the size of objects stored under its prefix
+	var capacity, used int64
+	haveUsage := false
+	condition := "Volume is mounted"
+	if vol := ns.volumes.find(volumeID, req.GetStagingTargetPath()); vol != nil {
+		capacity, used, haveUsage = ns.volumes.getUsage(vol)
+		if msg := daemonUsageMessage(ns.volumes.mountPath(vol, volumePath)); msg != "" {
+			condition += ", " + msg
+		}
+	}
+	if haveUsage {
+		available := capacity - used
+		if available < 0 {
+			available = 0
+		}
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     capacity,
+			Available: available,
+			Used:      used,
+		})
+	} else if haveStatfs {
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * statfs.Bsize,
+			Available: int64(statfs.Bavail) * statfs.Bsize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * statfs.Bsize,
+		})
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: usage,
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: false,
+			Message:  condition,
+		},
+	}, nil
+}
+
+// isReadOnlyCapability returns true if the volume can't be written by any of its consumers,
+// in which case the FUSE daemon itself is started in read-only mode
+func isReadOnlyCapability(capability *csi.VolumeCapability) bool {
+	mode := capability.GetAccessMode().GetMode()
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// bindMountOptions returns options for the bind mount of the staged volume into the target path.
+// The bind mount is remounted with these options by mount-utils, so even a writable FUSE mount
+// is protected from writes when the volume is published as read-only
+func bindMountOptions(logger klog.Logger, readOnly bool, mountFlags []string) []string {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	for _, flag := range mountFlags {
+		if !supportedMountFlags[flag] {
+			logger.Info("Ignoring unsupported mount flag", "flag", flag)
+			continue
+		}
+		if readOnly && (flag == "rw" || flag == "ro") {
+			continue
+		}
+		options = append(options, flag)
+	}
+	return options
+}
+
+const (
+	// Per-group mounts of a volume are created in a directory of its own next to the staging path,
+	// so that directories of other volumes sharing the parent are never touched
+	groupStagingDirPrefix = "csi-s3-groups-"
+	groupStagingPrefix    = "gid-"
+)
+
+func validateMountGroup(mountGroup string) error {
+	if mountGroup == "" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(mountGroup, 10, 32); err != nil {
+		return status.Errorf(codes.InvalidArgument, "Volume mount group must be a numeric GID, got %q", mountGroup)
+	}
+	return nil
+}
+
+// groupStagingDir returns the directory of per-group mounts of the volume staged in stagingTargetPath
+func groupStagingDir(stagingTargetPath string) string {
+	hash := sha256.Sum256([]byte(stagingTargetPath))
+	return filepath.Join(filepath.Dir(stagingTargetPath), groupStagingDirPrefix+hex.EncodeToString(hash[:8]))
+}
+
+func groupStagingPath(stagingTargetPath, mountGroup string) string {
+	return filepath.Join(groupStagingDir(stagingTargetPath), groupStagingPrefix+mountGroup)
+}
+
+// getMountGroup returns the group owning the root of a mounted volume,
+// all mounters use it as the group of all files in the volume
+func getMountGroup(path string) string {
+	st, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return strconv.FormatUint(uint64(sys.Gid), 10)
+	}
+	return ""
 }
 
 func checkMount(targetPath string) (bool, error) {
@@ -0,0 +1,251 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// fakeVolumeStats replaces stat and statfs of volume paths for the duration of the test
+func fakeVolumeStats(t *testing.T, statErr error, statfs *syscall.Statfs_t) {
+	t.Helper()
+	oldStat, oldStatfs := statVolume, statfsVolume
+	statVolume = func(name string) (os.FileInfo, error) {
+		if statErr != nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: statErr}
+		}
+		return nil, nil
+	}
+	statfsVolume = func(path string, buf *syscall.Statfs_t) error {
+		if statfs == nil {
+			return syscall.ENOSYS
+		}
+		*buf = *statfs
+		return nil
+	}
+	t.Cleanup(func() {
+		statVolume, statfsVolume = oldStat, oldStatfs
+	})
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	statfs := &syscall.Statfs_t{Bsize: 4096, Blocks: 100, Bfree: 40, Bavail: 30, Files: 1000, Ffree: 900}
+	inodes := &csi.VolumeUsage{Unit: csi.VolumeUsage_INODES, Total: 1000, Available: 900, Used: 100}
+	statfsBytes := &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Total: 409600, Available: 122880, Used: 245760}
+	tests := []struct {
+		name    string
+		statErr error
+		statfs  *syscall.Statfs_t
+		// pending marks a previous call on the path as still blocked in the kernel
+		pending bool
+		// capacity and used bytes of the staged volume, used is unknown if negative
+		capacity string
+		used     int64
+		wantCode codes.Code
+		want     []*csi.VolumeUsage
+		// wantAbnormal is a part of the message of an abnormal condition
+		wantAbnormal string
+	}{
+		{name: "statfs without capacity", statfs: statfs, used: -1, want: []*csi.VolumeUsage{inodes, statfsBytes}},
+		{name: "statfs failure", used: -1},
+		{
+			name: "usage within capacity", statfs: statfs, capacity: "1000", used: 300,
+			want: []*csi.VolumeUsage{inodes, {Unit: csi.VolumeUsage_BYTES, Total: 1000, Available: 700, Used: 300}},
+		},
+		{
+			name: "usage above capacity", statfs: statfs, capacity: "1000", used: 1500,
+			want: []*csi.VolumeUsage{inodes, {Unit: csi.VolumeUsage_BYTES, Total: 1000, Available: 0, Used: 1500}},
+		},
+		{name: "usage not calculated yet", statfs: statfs, capacity: "1000", used: -1, want: []*csi.VolumeUsage{inodes, statfsBytes}},
+		{name: "missing path", statErr: syscall.ENOENT, used: -1, wantCode: codes.NotFound},
+		{name: "dead mount", statErr: syscall.ENOTCONN, used: -1, wantAbnormal: "is dead"},
+		{name: "stale mount", statErr: syscall.ESTALE, used: -1, wantAbnormal: "is dead"},
+		{name: "hung mount", statfs: statfs, pending: true, used: -1, wantAbnormal: "is hung"},
+		{name: "other error", statErr: syscall.EINVAL, used: -1, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeVolumeStats(t, tt.statErr, tt.statfs)
+			volumePath := "/pods/" + strings.ReplaceAll(tt.name, " ", "-")
+			if tt.pending {
+				pendingMu.Lock()
+				pendingCalls[volumePath] = true
+				pendingMu.Unlock()
+				t.Cleanup(func() {
+					pendingMu.Lock()
+					delete(pendingCalls, volumePath)
+					pendingMu.Unlock()
+				})
+			}
+			ns := &nodeServer{volumes: newVolumeRegistry("")}
+			ns.volumes.add("vol-1", "/staging", false, "", map[string]string{"capacity": tt.capacity}, nil)
+			if tt.used >= 0 {
+				vol := ns.volumes.find("vol-1", "/staging")
+				vol.usage.bytes = tt.used
+				vol.usage.updated = time.Now()
+				vol.usage.checked = time.Now()
+			}
+
+			resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:          "vol-1",
+				VolumePath:        volumePath,
+				StagingTargetPath: "/staging",
+			})
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("NodeGetVolumeStats() error = %v, want %v", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NodeGetVolumeStats() failed: %v", err)
+			}
+			condition := resp.GetVolumeCondition()
+			if tt.wantAbnormal != "" {
+				if !condition.GetAbnormal() || !strings.Contains(condition.GetMessage(), tt.wantAbnormal) {
+					t.Errorf("condition = %v, want abnormal with %q", condition, tt.wantAbnormal)
+				}
+				return
+			}
+			if condition.GetAbnormal() {
+				t.Errorf("condition = %v, want normal", condition)
+			}
+			if len(resp.GetUsage()) != len(tt.want) {
+				t.Fatalf("usage = %v, want %v", resp.GetUsage(), tt.want)
+			}
+			for i, usage := range resp.GetUsage() {
+				want := tt.want[i]
+				if usage.Unit != want.Unit || usage.Total != want.Total || usage.Available != want.Available || usage.Used != want.Used {
+					t.Errorf("usage[%d] = %v, want %v", i, usage, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGetUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity string
+		secrets  map[string]string
+		listErr  error
+		wantOK   bool
+	}{
+		{name: "refreshed", capacity: "1000", secrets: map[string]string{"accessKeyID": "a"}, wantOK: true},
+		{name: "listing failed", capacity: "1000", secrets: map[string]string{"accessKeyID": "a"}, listErr: errors.New("access denied")},
+		{name: "unknown capacity", secrets: map[string]string{"accessKeyID": "a"}},
+		{name: "no secrets", capacity: "1000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldListUsage := listUsage
+			listUsage = func(ctx context.Context, volumeID string, volumeContext, secrets map[string]string) (int64, int64, error) {
+				if tt.listErr != nil {
+					return 0, 0, tt.listErr
+				}
+				return 300, 3, nil
+			}
+			t.Cleanup(func() { listUsage = oldListUsage })
+
+			r := newVolumeRegistry("")
+			r.add("vol-1", "/staging", false, "", map[string]string{"capacity": tt.capacity}, tt.secrets)
+			vol := r.find("vol-1", "/staging")
+			if _, _, ok := r.getUsage(vol); ok {
+				t.Fatal("getUsage() returned usage before it's calculated")
+			}
+			// the refresh runs in background and updates the usage under the lock
+			deadline := time.Now().Add(time.Second)
+			for {
+				r.mu.Lock()
+				refreshing := vol.usage.refreshing
+				r.mu.Unlock()
+				if !refreshing || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			capacity, used, ok := r.getUsage(vol)
+			if ok != tt.wantOK {
+				t.Fatalf("getUsage() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && (capacity != 1000 || used != 300) {
+				t.Errorf("getUsage() = %d, %d, want 1000, 300", capacity, used)
+			}
+		})
+	}
+}
+
+func TestCallWithTimeout(t *testing.T) {
+	path := "/pods/hung"
+	unblock := make(chan struct{})
+	err := callWithTimeout(path, 10*time.Millisecond, func() error {
+		<-unblock
+		return nil
+	})
+	if !errors.Is(err, errNoResponse) {
+		t.Fatalf("callWithTimeout() of a blocked call returned %v, want errNoResponse", err)
+	}
+	called := false
+	err = callWithTimeout(path, time.Second, func() error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, errNoResponse) || called {
+		t.Errorf("callWithTimeout() returned %v and called = %v while a previous call is blocked", err, called)
+	}
+
+	close(unblock)
+	deadline := time.Now().Add(time.Second)
+	for {
+		pendingMu.Lock()
+		pending := pendingCalls[path]
+		pendingMu.Unlock()
+		if !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the blocked call is still pending after it returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wantErr := errors.New("failed")
+	if err := callWithTimeout(path, time.Second, func() error { return wantErr }); err != wantErr {
+		t.Errorf("callWithTimeout() returned %v, want the error of the call", err)
+	}
+}
+
+func TestBindMountOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		readOnly   bool
+		mountFlags []string
+		want       []string
+	}{
+		{"writable", false, nil, []string{"bind"}},
+		{"read-only", true, nil, []string{"bind", "ro"}},
+		{"supported flags", false, []string{"noexec", "nosuid", "noatime"}, []string{"bind", "noexec", "nosuid", "noatime"}},
+		{"read-only flag", false, []string{"ro"}, []string{"bind", "ro"}},
+		{"rw of a read-only volume", true, []string{"rw", "nodev"}, []string{"bind", "ro", "nodev"}},
+		{"ro of a read-only volume", true, []string{"ro"}, []string{"bind", "ro"}},
+		{"unsupported flags", false, []string{"suid", "remount", "uid=0", "nodev"}, []string{"bind", "nodev"}},
+		{"unsupported flags of a read-only volume", true, []string{"dev", "exec"}, []string{"bind", "ro"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := bindMountOptions(klog.Background(), tt.readOnly, tt.mountFlags)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("bindMountOptions(%v, %q) = %q, want %q", tt.readOnly, tt.mountFlags, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// sanitized formats CSI requests and responses for logs without secrets
+type sanitized struct {
+	msg interface{}
+}
+
+func (s sanitized) String() string {
+	msg, ok := s.msg.(proto.Message)
+	if !ok {
+		return fmt.Sprintf("%+v", s.msg)
+	}
+	msg = proto.Clone(msg)
+	stripSecrets(msg.ProtoReflect())
+	return fmt.Sprintf("%+v", msg)
+}
+
+// LogValue formats messages as JSON objects with --log-format=json, which would otherwise
+// serialize the struct without exported fields as {}
+func (s sanitized) LogValue() slog.Value {
+	msg, ok := s.msg.(proto.Message)
+	if !ok {
+		return slog.StringValue(s.String())
+	}
+	msg = proto.Clone(msg)
+	stripSecrets(msg.ProtoReflect())
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		return slog.StringValue(fmt.Sprintf("%+v", msg))
+	}
+	return slog.AnyValue(json.RawMessage(data))
+}
+
+// sanitizedContext returns a copy of the volume context with credential-looking mount options redacted
+func sanitizedContext(volumeContext map[string]string) map[string]string {
+	sanitized := make(map[string]string, len(volumeContext))
+	for k, v := range volumeContext {
+		sanitized[k] = v
+	}
+	if options, ok := sanitized[mounter.OptionsKey]; ok {
+		sanitized[mounter.OptionsKey] = mounter.SanitizeOptions(options)
+	}
+	return sanitized
+}
+
+// isSecretField returns true if the field is marked with the csi_secret option in the CSI spec
+func isSecretField(fd protoreflect.FieldDescriptor) bool {
+	secret, _ := proto.GetExtension(fd.Options(), csi.E_CsiSecret).(bool)
+	return secret
+}
+
+// stripSecrets replaces values of all csi_secret fields of the message and credential-looking
+// mount options in the options volume attribute
+func stripSecrets(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case isSecretField(fd) && fd.IsMap():
+			replaceMapValues(v.Map(), func(_, _ string) string { return mounter.Redacted })
+		case isSecretField(fd) && fd.Kind() == protoreflect.StringKind && !fd.IsList():
+			m.Set(fd, protoreflect.ValueOfString(mounter.Redacted))
+		case fd.IsMap() && fd.MapValue().Kind() == protoreflect.StringKind:
+			replaceMapValues(v.Map(), func(key, value string) string {
+				if key == mounter.OptionsKey {
+					return mounter.SanitizeOptions(value)
+				}
+				return value
+			})
+		case fd.IsMap() && fd.MapValue().Kind() == protoreflect.MessageKind:
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				stripSecrets(mv.Message())
+				return true
+			})
+		case fd.IsList() && fd.Kind() == protoreflect.MessageKind:
+			for i := 0; i < v.List().Len(); i++ {
+				stripSecrets(v.List().Get(i).Message())
+			}
+		case fd.Kind() == protoreflect.MessageKind && !fd.IsMap() && !fd.IsList():
+			stripSecrets(v.Message())
+		}
+		return true
+	})
+}
+
+// replaceMapValues sets every value of a string map to the one returned by replace
+func replaceMapValues(m protoreflect.Map, replace func(key, value string) string) {
+	values := make(map[string]string)
+	m.Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+		values[k.String()] = v.String()
+		return true
+	})
+	for key, value := range values {
+		m.Set(protoreflect.ValueOfString(key).MapKey(), protoreflect.ValueOfString(replace(key, value)))
+	}
+}
+
+// secretValues returns credentials from csi_secret fields of the request, which must never appear in errors
+func secretValues(req interface{}) []string {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return nil
+	}
+	var values []string
+	var collect func(m protoreflect.Message)
+	collect = func(m protoreflect.Message) {
+		m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+			switch {
+			case isSecretField(fd) && fd.IsMap():
+				v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+					// endpoints and regions are kept in secrets too, but they are useful in errors
+					if mounter.IsSecretOption(k.String()) && mv.String() != "" {
+						values = append(values, mv.String())
+					}
+					return true
+				})
+			case isSecretField(fd) && fd.Kind() == protoreflect.StringKind && !fd.IsList():
+				if v.String() != "" {
+					values = append(values, v.String())
+				}
+			case fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap():
+				collect(v.Message())
+			}
+			return true
+		})
+	}
+	collect(msg.ProtoReflect())
+	return values
+}
+
+// redactError removes secrets of the request from the error, keeping its gRPC code
+func redactError(err error, secrets []string) error {
+	if err == nil || len(secrets) == 0 {
+		return err
+	}
+	// errors without a status are reported with codes.Unknown by gRPC anyway
+	s, _ := status.FromError(err)
+	msg := s.Message()
+	for _, secret := range secrets {
+		msg = strings.ReplaceAll(msg, secret, mounter.Redacted)
+	}
+	if msg == s.Message() {
+		return err
+	}
+	return status.Error(s.Code(), msg)
+}
@@ -0,0 +1,149 @@
+package driver_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/driver"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+)
+
+// klogFlags controls the verbosity of klog in tests, they are not registered in the global flag set
+var klogFlags = flag.NewFlagSet("klog", flag.PanicOnError)
+
+func init() {
+	klog.InitFlags(klogFlags)
+}
+
+// captureStderr returns everything written to stderr, where klog logs, while fn runs
+func captureStderr(fn func()) string {
+	r, w, err := os.Pipe()
+	Expect(err).NotTo(HaveOccurred())
+	stderr := os.Stderr
+	os.Stderr = w
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	defer func() {
+		os.Stderr = stderr
+	}()
+	fn()
+	os.Stderr = stderr
+	w.Close()
+	return <-output
+}
+
+var _ = Describe("Secret redaction", func() {
+	secrets := map[string]string{
+		"accessKeyID":     "AKIDREDACTIONTEST1",
+		"secretAccessKey": "SECRETREDACTIONTEST2",
+		"endpoint":        "http://127.0.0.1:9000",
+	}
+	optionSecret := "OPTIONREDACTIONTEST3"
+	volumeContext := map[string]string{
+		"mounter": "rclone",
+		"options": "--s3-secret-access-key=" + optionSecret + " --s3-session-token " + optionSecret + " -o passwd=" + optionSecret + ",ro",
+	}
+	secretValues := []string{secrets["accessKeyID"], secrets["secretAccessKey"], optionSecret}
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}
+	requests := map[string]interface{}{
+		"CreateVolume": &csi.CreateVolumeRequest{
+			Name: "pvc-1", Parameters: volumeContext, Secrets: secrets,
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+		},
+		"DeleteVolume": &csi.DeleteVolumeRequest{VolumeId: "pvc-1", Secrets: secrets},
+		"ControllerPublishVolume": &csi.ControllerPublishVolumeRequest{
+			VolumeId: "pvc-1", NodeId: "node", VolumeContext: volumeContext, Secrets: secrets,
+		},
+		"NodeStageVolume": &csi.NodeStageVolumeRequest{
+			VolumeId: "pvc-1", StagingTargetPath: "/staging", VolumeCapability: capability,
+			VolumeContext: volumeContext, Secrets: secrets,
+		},
+		"NodePublishVolume": &csi.NodePublishVolumeRequest{
+			VolumeId: "pvc-1", StagingTargetPath: "/staging", TargetPath: "/target",
+			VolumeCapability: capability, VolumeContext: volumeContext, Secrets: secrets,
+		},
+		"ControllerExpandVolume": &csi.ControllerExpandVolumeRequest{VolumeId: "pvc-1", Secrets: secrets},
+		"NodeExpandVolume": &csi.NodeExpandVolumeRequest{
+			VolumeId: "pvc-1", VolumePath: "/target", Secrets: secrets,
+		},
+	}
+
+	var verbosity string
+	BeforeEach(func() {
+		verbosity = klogFlags.Lookup("v").Value.String()
+		Expect(klogFlags.Set("v", "5")).To(Succeed())
+		Expect(klogFlags.Set("logtostderr", "true")).To(Succeed())
+	})
+	AfterEach(func() {
+		Expect(klogFlags.Set("v", verbosity)).To(Succeed())
+	})
+
+	for method, req := range requests {
+		method, req := method, req
+		It("keeps secrets of "+method+" out of logs and errors", func() {
+			info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1/" + method}
+			var errs []error
+			output := captureStderr(func() {
+				// a successful call logs the response, which includes the volume context of CreateVolume
+				_, err := driver.LogGRPC(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "pvc-1", VolumeContext: volumeContext}}, nil
+				})
+				errs = append(errs, err)
+				// errors of mounters and S3 clients may include anything they got
+				_, err = driver.LogGRPC(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return nil, fmt.Errorf("failed with %v", secrets)
+				})
+				errs = append(errs, err)
+			})
+			Expect(output).To(ContainSubstring("***stripped***"))
+			Expect(errs[0]).NotTo(HaveOccurred())
+			Expect(errs[1]).To(HaveOccurred())
+			for _, secret := range secretValues {
+				Expect(output).NotTo(ContainSubstring(secret))
+				Expect(errs[1].Error()).NotTo(ContainSubstring(secret))
+			}
+		})
+	}
+
+	It("logs requests as JSON objects without secrets with --log-format=json", func() {
+		var output bytes.Buffer
+		klog.SetLogger(logr.FromSlogHandler(slog.NewJSONHandler(&output, &slog.HandlerOptions{Level: slog.Level(-5)})))
+		defer klog.ClearLogger()
+		req := requests["NodeStageVolume"]
+		info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1/NodeStageVolume"}
+		_, err := driver.LogGRPC(context.Background(), req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &csi.NodeStageVolumeResponse{}, nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		var logged map[string]interface{}
+		for _, line := range bytes.Split(bytes.TrimSpace(output.Bytes()), []byte("\n")) {
+			var entry map[string]interface{}
+			Expect(json.Unmarshal(line, &entry)).To(Succeed())
+			if entry["request"] != nil {
+				logged = entry
+			}
+		}
+		Expect(logged).NotTo(BeNil())
+		Expect(logged["request"]).To(HaveKeyWithValue("volumeId", "pvc-1"))
+		Expect(logged["request"]).To(HaveKeyWithValue("secrets", HaveKeyWithValue("secretAccessKey", "***stripped***")))
+		for _, secret := range secretValues {
+			Expect(output.String()).NotTo(ContainSubstring(secret))
+		}
+	})
+})
@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Variables of sub-path templates, taken from pod info in the volume context
+var subPathVariables = map[string]string{
+	"pod.namespace":       podNamespaceKey,
+	"pod.name":            podNameKey,
+	"serviceAccount.name": serviceAccountNameKey,
+}
+
+// expandSubPath renders the sub-path template of the volume, like "${pod.namespace}/${pod.name}",
+// and returns a relative path which can't point outside of the volume
+func expandSubPath(volumeContext map[string]string) (string, error) {
+	template := volumeContext[mounter.SubPathKey]
+	if template == "" {
+		return "", nil
+	}
+	var expandErr error
+	subPath := os.Expand(template, func(name string) string {
+		key, ok := subPathVariables[name]
+		if !ok {
+			expandErr = status.Errorf(codes.InvalidArgument, "Unknown variable %q in %s %q", name, mounter.SubPathKey, template)
+			return ""
+		}
+		value := volumeContext[key]
+		if value == "" {
+			// kubelet only passes pod info if podInfoOnMount is enabled for the driver
+			expandErr = status.Errorf(codes.FailedPrecondition, "%s %q requires %s, but it's missing in the volume context", mounter.SubPathKey, template, key)
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	subPath = strings.TrimPrefix(filepath.Clean("/"+subPath), "/")
+	if subPath == "" {
+		return "", status.Errorf(codes.InvalidArgument, "%s %q points to the root of the volume", mounter.SubPathKey, template)
+	}
+	return subPath, nil
+}
+
+// subPathMode is the mode of created sub-path directories. They are writable by the mount group,
+// which kubelet sets to the fsGroup of the pod, but not by everyone
+const subPathMode = 0775
+
+// prepareSubPath creates the sub-path in the mounted volume if it doesn't exist yet and returns its full path
+func prepareSubPath(root, subPath string) (string, error) {
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %v: %v", root, err)
+	}
+	// Some mounters support symlinks, which must not lead outside of the volume
+	if err := checkSubPathLinks(resolvedRoot, subPath); err != nil {
+		return "", err
+	}
+	// os.Root refuses to follow symlinks out of the volume, even if they are created meanwhile
+	volume, err := os.OpenRoot(resolvedRoot)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %v: %v", root, err)
+	}
+	defer volume.Close()
+	if err := volume.MkdirAll(subPath, subPathMode); err != nil {
+		return "", fmt.Errorf("failed to create sub-path %v in %v: %v", subPath, root, err)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(resolvedRoot, subPath))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve sub-path %v in %v: %v", subPath, root, err)
+	}
+	if !strings.HasPrefix(resolved, resolvedRoot+"/") {
+		return "", status.Errorf(codes.InvalidArgument, "Sub-path %v points outside of the volume", subPath)
+	}
+	return resolved, nil
+}
+
+// checkSubPathLinks fails if an existing part of the sub-path is a symlink leading outside of the
+// resolved root, or a dangling one, which would make directories be created wherever it points
+func checkSubPathLinks(resolvedRoot, subPath string) error {
+	path := resolvedRoot
+	for _, name := range strings.Split(subPath, "/") {
+		path = filepath.Join(path, name)
+		resolved, err := filepath.EvalSymlinks(path)
+		if os.IsNotExist(err) {
+			if _, lstatErr := os.Lstat(path); lstatErr == nil {
+				return status.Errorf(codes.InvalidArgument, "Sub-path %v contains a dangling symlink %v", subPath, name)
+			}
+			// the rest of the sub-path is created
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resolve sub-path %v: %v", path, err)
+		}
+		if !strings.HasPrefix(resolved, resolvedRoot+"/") {
+			return status.Errorf(codes.InvalidArgument, "Sub-path %v points outside of the volume", subPath)
+		}
+		path = resolved
+	}
+	return nil
+}
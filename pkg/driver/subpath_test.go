@@ -0,0 +1,144 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestExpandSubPath(t *testing.T) {
+	podInfo := map[string]string{
+		podNamespaceKey:       "default",
+		podNameKey:            "web-0",
+		serviceAccountNameKey: "web",
+	}
+	tests := []struct {
+		name     string
+		template string
+		podInfo  map[string]string
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "no sub-path"},
+		{name: "static", template: "data", want: "data"},
+		{name: "variables", template: "${pod.namespace}/${pod.name}", podInfo: podInfo, want: "default/web-0"},
+		{name: "service account", template: "sa-${serviceAccount.name}", podInfo: podInfo, want: "sa-web"},
+		{name: "absolute path", template: "/data/${pod.name}", podInfo: podInfo, want: "data/web-0"},
+		{name: "undefined variable", template: "${pod.uid}", podInfo: podInfo, wantCode: codes.InvalidArgument},
+		{name: "missing pod info", template: "${pod.name}", wantCode: codes.FailedPrecondition},
+		{name: "escape with dots", template: "../../etc", want: "etc"},
+		{name: "escape in a variable", template: "${pod.name}/data", podInfo: map[string]string{podNameKey: "../.."}, want: "data"},
+		{name: "root of the volume", template: "a/..", wantCode: codes.InvalidArgument},
+		{name: "root with dots", template: "..", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumeContext := map[string]string{mounter.SubPathKey: tt.template}
+			for k, v := range tt.podInfo {
+				volumeContext[k] = v
+			}
+			got, err := expandSubPath(volumeContext)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expandSubPath(%q) error = %v, want %v", tt.template, err, tt.wantCode)
+			}
+			if got != tt.want {
+				t.Errorf("expandSubPath(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareSubPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		subPath string
+		// setup prepares the volume in root, outside is a directory next to it
+		setup    func(t *testing.T, root, outside string)
+		want     string
+		wantCode codes.Code
+	}{
+		{name: "new directory", subPath: "a/b", want: "a/b"},
+		{name: "existing directory", subPath: "a", setup: mkdir("a"), want: "a"},
+		{
+			name: "symlink inside the volume", subPath: "link/b", want: "a/b",
+			setup: func(t *testing.T, root, outside string) {
+				mkdir("a")(t, root, outside)
+				symlink(t, "a", filepath.Join(root, "link"))
+			},
+		},
+		{
+			name: "symlink outside the volume", subPath: "link/b", wantCode: codes.InvalidArgument,
+			setup: func(t *testing.T, root, outside string) {
+				symlink(t, outside, filepath.Join(root, "link"))
+			},
+		},
+		{
+			name: "relative symlink outside the volume", subPath: "a/link", wantCode: codes.InvalidArgument,
+			setup: func(t *testing.T, root, outside string) {
+				mkdir("a")(t, root, outside)
+				symlink(t, filepath.Join("..", "..", filepath.Base(outside)), filepath.Join(root, "a", "link"))
+			},
+		},
+		{
+			name: "dangling symlink outside the volume", subPath: "link/b", wantCode: codes.InvalidArgument,
+			setup: func(t *testing.T, root, outside string) {
+				symlink(t, filepath.Join(outside, "missing"), filepath.Join(root, "link"))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			root := filepath.Join(dir, "volume")
+			outside := filepath.Join(dir, "outside")
+			for _, path := range []string{root, outside} {
+				if err := os.Mkdir(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.setup != nil {
+				tt.setup(t, root, outside)
+			}
+			got, err := prepareSubPath(root, tt.subPath)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("prepareSubPath(%q) error = %v, want %v", tt.subPath, err, tt.wantCode)
+			}
+			if tt.wantCode != codes.OK {
+				entries, err := os.ReadDir(outside)
+				if err != nil || len(entries) != 0 {
+					t.Errorf("prepareSubPath(%q) created %v outside of the volume", tt.subPath, entries)
+				}
+				return
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("prepareSubPath(%q) = %q, want %q", tt.subPath, got, want)
+			}
+			st, err := os.Stat(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := st.Mode(); !mode.IsDir() || mode.Perm()&0002 != 0 {
+				t.Errorf("sub-path %v has mode %v, want a directory not writable by others", got, mode)
+			}
+		})
+	}
+}
+
+func mkdir(name string) func(t *testing.T, root, outside string) {
+	return func(t *testing.T, root, outside string) {
+		if err := os.MkdirAll(filepath.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func symlink(t *testing.T, oldname, newname string) {
+	t.Helper()
+	if err := os.Symlink(oldname, newname); err != nil {
+		t.Fatal(err)
+	}
+}
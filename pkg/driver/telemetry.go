@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"fmt"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/metrics"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/mounter"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// FUSE daemons using more of their memory limit are reported in NodeGetVolumeStats
+const memoryNearLimit = 0.9
+
+// daemonMount identifies the FUSE daemon of a volume mount in telemetry
+type daemonMount struct {
+	volumeID    string
+	pvc         string
+	namespace   string
+	path        string
+	memoryLimit int64
+	remounts    int64
+}
+
+// volumeMemoryLimit returns the memory limit of FUSE daemons of the volume, 0 if it's unlimited
+func volumeMemoryLimit(volumeContext map[string]string) int64 {
+	if limit := volumeContext[mounter.MemoryLimitKey]; limit != "" {
+		if q, err := resource.ParseQuantity(limit); err == nil && q.Value() > 0 {
+			return q.Value()
+		}
+	}
+	return mounter.DefaultLimits.MemoryMax
+}
+
+// daemonMounts returns FUSE mounts of all staged volumes
+func (r *volumeRegistry) daemonMounts() []daemonMount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var mounts []daemonMount
+	for _, vol := range r.volumes {
+		pvc, namespace := vol.VolumeContext[pvcNameKey], vol.VolumeContext[pvcNamespaceKey]
+		if vol.Pod != nil {
+			namespace = vol.Pod.Namespace
+		}
+		for path := range vol.mounts() {
+			mounts = append(mounts, daemonMount{
+				volumeID:    vol.VolumeID,
+				pvc:         pvc,
+				namespace:   namespace,
+				path:        path,
+				memoryLimit: volumeMemoryLimit(vol.VolumeContext),
+				remounts:    vol.remounts[path],
+			})
+		}
+	}
+	return mounts
+}
+
+// volumeDaemons collects resource usage of FUSE daemons of all staged volumes
+func (ns *nodeServer) volumeDaemons() []metrics.VolumeDaemon {
+	var daemons []metrics.VolumeDaemon
+	for _, m := range ns.volumes.daemonMounts() {
+		stats, err := mounter.GetDaemonStats(m.path)
+		if err != nil {
+			klog.V(4).InfoS("Failed to get resource usage of FUSE daemon", "volumeID", m.volumeID, "path", m.path, "err", err)
+			continue
+		}
+		if stats == nil {
+			continue
+		}
+		daemons = append(daemons, metrics.VolumeDaemon{
+			VolumeID:    m.volumeID,
+			PVC:         m.pvc,
+			Namespace:   m.namespace,
+			Path:        m.path,
+			CPUSeconds:  stats.CPUSeconds,
+			RSSBytes:    stats.RSSBytes,
+			MemoryLimit: m.memoryLimit,
+			Restarts:    stats.Restarts + m.remounts,
+		})
+	}
+	return daemons
+}
+
+// daemonUsageMessage describes memory usage of the FUSE daemon of the mount if it's close to its limit,
+// empty otherwise
+func daemonUsageMessage(path string, memoryLimit int64) string {
+	if memoryLimit <= 0 {
+		return ""
+	}
+	stats, err := mounter.GetDaemonStats(path)
+	if err != nil || stats == nil {
+		return ""
+	}
+	if float64(stats.RSSBytes) < memoryNearLimit*float64(memoryLimit) {
+		return ""
+	}
+	return fmt.Sprintf("FUSE daemon uses %d MiB of its %d MiB memory limit",
+		stats.RSSBytes>>20, memoryLimit>>20)
+}
@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// Well-known labels of nodes published as their topology
+	topologyRegionKey = v1.LabelTopologyRegion
+	topologyZoneKey   = v1.LabelTopologyZone
+	// topologyEndpointsKey is the StorageClass parameter mapping topology segments to S3 endpoints
+	topologyEndpointsKey = "topologyEndpoints"
+	// Volume attributes overriding the endpoint and the region of the secret of a volume
+	endpointKey = "endpoint"
+	regionKey   = "region"
+	// volumeIDEndpointSeparator separates the endpoint of a topology volume in its ID. Names of buckets
+	// and volumes can't contain it, and the endpoint follows as "endpoint=..."
+	volumeIDEndpointSeparator = "@"
+)
+
+// topologyEndpoint is the S3 endpoint for volumes created for nodes in a topology segment
+type topologyEndpoint struct {
+	// Topology is matched by nodes with all of these labels
+	Topology map[string]string `json:"topology"`
+	Endpoint string            `json:"endpoint"`
+	Region   string            `json:"region,omitempty"`
+}
+
+// parseTopologyEndpoints reads the list of endpoints from the StorageClass parameter
+func parseTopologyEndpoints(value string) ([]topologyEndpoint, error) {
+	var endpoints []topologyEndpoint
+	if err := yaml.UnmarshalStrict([]byte(value), &endpoints); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", topologyEndpointsKey, err)
+	}
+	for i, e := range endpoints {
+		if len(e.Topology) == 0 || e.Endpoint == "" {
+			return nil, fmt.Errorf("entry %d of %s must have topology and endpoint", i, topologyEndpointsKey)
+		}
+	}
+	return endpoints, nil
+}
+
+// matches returns true if the topology has all segments of the endpoint
+func (e *topologyEndpoint) matches(topology *csi.Topology) bool {
+	for key, value := range e.Topology {
+		if topology.GetSegments()[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// selectTopologyEndpoint returns the first endpoint matching the preferred topologies in their order,
+// then the requisite ones, so that a volume delayed until its pod is scheduled is created in the
+// endpoint nearest to the node of the pod. It returns nil if there is no matching endpoint
+func selectTopologyEndpoint(endpoints []topologyEndpoint, req *csi.TopologyRequirement) *topologyEndpoint {
+	for _, topologies := range [][]*csi.Topology{req.GetPreferred(), req.GetRequisite()} {
+		for _, topology := range topologies {
+			for i := range endpoints {
+				if endpoints[i].matches(topology) {
+					return &endpoints[i]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// volumeSecrets returns the secrets of the volume with the endpoint and the region replaced by the ones
+// chosen for its topology. Attributes of ephemeral volumes are set by pod authors, so they are ignored
+func volumeSecrets(secrets, volumeContext map[string]string) map[string]string {
+	if volumeContext[endpointKey] == "" || isEphemeral(volumeContext) {
+		return secrets
+	}
+	merged := make(map[string]string, len(secrets)+2)
+	for k, v := range secrets {
+		merged[k] = v
+	}
+	merged[endpointKey] = volumeContext[endpointKey]
+	if volumeContext[regionKey] != "" {
+		merged[regionKey] = volumeContext[regionKey]
+	}
+	return merged
+}
+
+// nodeTopology returns the region and the zone of the node from its labels. The topology is empty
+// if the driver runs outside of a cluster or the node has no such labels
+func (d *driver) nodeTopology(ctx context.Context) (*csi.Topology, error) {
+	segments := make(map[string]string)
+	if d.kube != nil {
+		node, err := d.kube.CoreV1().Nodes().Get(ctx, d.nodeID, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get node %v: %v", d.nodeID, err)
+		}
+		for _, key := range []string{topologyRegionKey, topologyZoneKey} {
+			if value := node.Labels[key]; value != "" {
+				segments[key] = value
+			}
+		}
+	}
+	return &csi.Topology{Segments: segments}, nil
+}
+
+// topologyVolumeID appends the endpoint and the region chosen for the topology of the volume to its ID,
+// so that DeleteVolume, which gets neither parameters nor attributes, deletes it in the right endpoint
+func topologyVolumeID(volumeID string, endpoint *topologyEndpoint) string {
+	values := url.Values{}
+	values.Set(endpointKey, endpoint.Endpoint)
+	if endpoint.Region != "" {
+		values.Set(regionKey, endpoint.Region)
+	}
+	return volumeID + volumeIDEndpointSeparator + values.Encode()
+}
+
+// splitVolumeID returns the bucket and prefix part of the volume ID and the endpoint and the region
+// appended to it by topologyVolumeID as volume attributes, which are nil for other volumes
+func splitVolumeID(volumeID string) (string, map[string]string) {
+	i := strings.LastIndex(volumeID, volumeIDEndpointSeparator)
+	if i < 0 {
+		return volumeID, nil
+	}
+	values, err := url.ParseQuery(volumeID[i+1:])
+	if err != nil || values.Get(endpointKey) == "" {
+		return volumeID, nil
+	}
+	volumeContext := map[string]string{endpointKey: values.Get(endpointKey)}
+	if region := values.Get(regionKey); region != "" {
+		volumeContext[regionKey] = region
+	}
+	return volumeID[:i], volumeContext
+}
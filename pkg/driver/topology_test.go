@@ -0,0 +1,148 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestParseTopologyEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []topologyEndpoint
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			value: `
+- topology: {topology.kubernetes.io/zone: a}
+  endpoint: https://a.example.com
+  region: r
+- topology: {topology.kubernetes.io/zone: b}
+  endpoint: https://b.example.com`,
+			want: []topologyEndpoint{
+				{Topology: map[string]string{topologyZoneKey: "a"}, Endpoint: "https://a.example.com", Region: "r"},
+				{Topology: map[string]string{topologyZoneKey: "b"}, Endpoint: "https://b.example.com"},
+			},
+		},
+		{name: "not a list", value: `endpoint: https://a.example.com`, wantErr: true},
+		{name: "invalid YAML", value: `- topology: [`, wantErr: true},
+		{name: "unknown field", value: `[{topology: {zone: a}, endpoint: https://a.example.com, url: x}]`, wantErr: true},
+		{name: "missing topology", value: `[{endpoint: https://a.example.com}]`, wantErr: true},
+		{name: "empty topology", value: `[{topology: {}, endpoint: https://a.example.com}]`, wantErr: true},
+		{name: "missing endpoint", value: `[{topology: {zone: a}}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTopologyEndpoints(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTopologyEndpoints() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTopologyEndpoints() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectTopologyEndpoint(t *testing.T) {
+	endpoints := []topologyEndpoint{
+		{Topology: map[string]string{topologyRegionKey: "east", topologyZoneKey: "a"}, Endpoint: "https://east-a"},
+		{Topology: map[string]string{topologyRegionKey: "east"}, Endpoint: "https://east"},
+		{Topology: map[string]string{topologyRegionKey: "west"}, Endpoint: "https://west"},
+	}
+	node := func(region, zone string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{topologyRegionKey: region, topologyZoneKey: zone}}
+	}
+	tests := []struct {
+		name string
+		req  *csi.TopologyRequirement
+		want string
+	}{
+		{
+			name: "first matching endpoint",
+			req:  &csi.TopologyRequirement{Preferred: []*csi.Topology{node("east", "a")}},
+			want: "https://east-a",
+		},
+		{
+			name: "endpoint with fewer segments",
+			req:  &csi.TopologyRequirement{Preferred: []*csi.Topology{node("east", "b")}},
+			want: "https://east",
+		},
+		{
+			name: "preferred before requisite",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{node("east", "a")},
+				Preferred: []*csi.Topology{node("west", "c")},
+			},
+			want: "https://west",
+		},
+		{
+			name: "preferred in their order",
+			req:  &csi.TopologyRequirement{Preferred: []*csi.Topology{node("west", "c"), node("east", "a")}},
+			want: "https://west",
+		},
+		{
+			name: "requisite if no preferred matches",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{node("north", "x"), node("east", "b")},
+				Preferred: []*csi.Topology{node("north", "x")},
+			},
+			want: "https://east",
+		},
+		{
+			name: "no matching segment",
+			req:  &csi.TopologyRequirement{Requisite: []*csi.Topology{node("north", "x")}},
+		},
+		{
+			name: "no zone label",
+			req:  &csi.TopologyRequirement{Requisite: []*csi.Topology{{Segments: map[string]string{topologyZoneKey: "a"}}}},
+		},
+		{
+			name: "empty requirement",
+			req:  &csi.TopologyRequirement{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectTopologyEndpoint(endpoints, tt.req)
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("selectTopologyEndpoint() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.Endpoint != tt.want {
+				t.Errorf("selectTopologyEndpoint() = %+v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopologyVolumeID(t *testing.T) {
+	endpoint := &topologyEndpoint{Endpoint: "https://s3.east.example.com:9000/path", Region: "east"}
+	for _, base := range []string{"pvc-1", "bucket/pvc-1"} {
+		id := topologyVolumeID(base, endpoint)
+		gotBase, volumeContext := splitVolumeID(id)
+		if gotBase != base {
+			t.Errorf("splitVolumeID(%q) returned %q, want %q", id, gotBase, base)
+		}
+		want := map[string]string{endpointKey: endpoint.Endpoint, regionKey: endpoint.Region}
+		if !reflect.DeepEqual(volumeContext, want) {
+			t.Errorf("splitVolumeID(%q) returned %v, want %v", id, volumeContext, want)
+		}
+		bucket, prefix := volumeIDToBucketPrefix(id)
+		wantBucket, wantPrefix := volumeIDToBucketPrefix(base)
+		if bucket != wantBucket || prefix != wantPrefix {
+			t.Errorf("volumeIDToBucketPrefix(%q) = %q, %q, want %q, %q", id, bucket, prefix, wantBucket, wantPrefix)
+		}
+	}
+	// IDs of static volumes may contain the separator in their prefixes
+	for _, id := range []string{"bucket/user@example.com", "bucket/a@b=c"} {
+		if base, volumeContext := splitVolumeID(id); base != id || volumeContext != nil {
+			t.Errorf("splitVolumeID(%q) = %q, %v, want the ID without attributes", id, base, volumeContext)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package driver_test
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/driver"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// testCollector is an in-process OTLP receiver keeping all spans it gets
+type testCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *testCollector) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+// span returns the first received span with the name, nil if there is none
+func (c *testCollector) span(name string) *tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+var _ = Describe("Tracing", func() {
+	const (
+		traceID  = "0af7651916cd43dd8448eb211c80319c"
+		parentID = "b7ad6b7169203331"
+		socket   = "/tmp/csi-tracing.sock"
+	)
+	secrets := map[string]string{
+		"accessKeyID":     "FJDSJ",
+		"secretAccessKey": "DSG643HGDS",
+		"endpoint":        "http://127.0.0.1:9000",
+	}
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	var (
+		collector *testCollector
+		server    *grpc.Server
+		shutdown  func(context.Context) error
+		conn      *grpc.ClientConn
+	)
+
+	BeforeEach(func() {
+		collector = &testCollector{}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		server = grpc.NewServer()
+		collectortrace.RegisterTraceServiceServer(server, collector)
+		go server.Serve(listener)
+
+		shutdown, err = tracing.Setup(context.Background(), tracing.Config{
+			Endpoint:    listener.Addr().String(),
+			Insecure:    true,
+			SampleRatio: 1,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		d, err := driver.New("test-node", "unix://"+socket, testConfig())
+		Expect(err).NotTo(HaveOccurred())
+		go d.Run()
+		conn, err = grpc.NewClient("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() error {
+			_, err := csi.NewIdentityClient(conn).Probe(context.Background(), &csi.ProbeRequest{})
+			return err
+		}).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		server.Stop()
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	})
+
+	It("continues the trace of the caller in S3 operations and mounts", func() {
+		// the caller's span is sent in W3C traceparent metadata
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "traceparent", "00-"+traceID+"-"+parentID+"-01")
+		// CreateVolume and NodeStageVolume may fail without a real S3 and FUSE, their spans are exported anyway
+		csi.NewControllerClient(conn).CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "tracing-test",
+			VolumeCapabilities: []*csi.VolumeCapability{capability},
+			Parameters:         map[string]string{"mounter": "geesefs"},
+			Secrets:            secrets,
+		})
+		stagingPath := os.TempDir() + "/tracing-staging"
+		node := csi.NewNodeClient(conn)
+		node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "tracing-test",
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  capability,
+			VolumeContext:     map[string]string{"mounter": "geesefs"},
+			Secrets:           secrets,
+		})
+		node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          "tracing-test",
+			StagingTargetPath: stagingPath,
+		})
+		Expect(shutdown(context.Background())).To(Succeed())
+
+		create := collector.span("csi.v1.Controller/CreateVolume")
+		Expect(create).NotTo(BeNil())
+		Expect(hex.EncodeToString(create.TraceId)).To(Equal(traceID))
+		Expect(hex.EncodeToString(create.ParentSpanId)).To(Equal(parentID))
+		Expect(create.Kind).To(Equal(tracepb.Span_SPAN_KIND_SERVER))
+
+		bucketExists := collector.span("s3.BucketExists")
+		Expect(bucketExists).NotTo(BeNil())
+		Expect(bucketExists.TraceId).To(Equal(create.TraceId))
+		Expect(bucketExists.ParentSpanId).To(Equal(create.SpanId))
+
+		stage := collector.span("csi.v1.Node/NodeStageVolume")
+		Expect(stage).NotTo(BeNil())
+		Expect(hex.EncodeToString(stage.TraceId)).To(Equal(traceID))
+		mount := collector.span("mount")
+		Expect(mount).NotTo(BeNil())
+		Expect(mount.ParentSpanId).To(Equal(stage.SpanId))
+
+		unstage := collector.span("csi.v1.Node/NodeUnstageVolume")
+		Expect(unstage).NotTo(BeNil())
+		Expect(unstage.TraceId).NotTo(Equal(create.TraceId))
+	})
+})
@@ -0,0 +1,393 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Bucket listings are expensive, so usage of every volume is refreshed at most this often
+	usageRefreshInterval = 5 * time.Minute
+)
+
+// stagedVolume is a volume staged on this node
+type stagedVolume struct {
+	VolumeID      string
+	StagingPath   string
+	VolumeContext map[string]string
+	ReadOnly      bool
+	MountGroup    string
+	// Targets are bind mounts of the volume into pods, by target path
+	Targets map[string]*publishedTarget
+	// PVName references the PersistentVolume whose secret is used to remount the volume
+	// after a restart of the node plugin. Secrets themselves are never written to disk
+	PVName string
+	// Ephemeral inline volumes are mounted directly in the target path, which is used as StagingPath.
+	// Their secrets are referenced by the Pod instead of a PersistentVolume
+	Ephemeral bool
+	Pod       *podVolume `json:",omitempty"`
+	// CredentialsHash identifies credentials the volume is mounted with, to notice their rotation
+	CredentialsHash string `json:",omitempty"`
+
+	// secrets are only kept in memory
+	secrets map[string]string
+
+	usage volumeUsage
+	// health of FUSE mounts of the volume, by mount path
+	health map[string]*mountHealth
+	// remounts of FUSE mounts of the volume since the start of the node plugin, by mount path
+	remounts map[string]int64
+}
+
+// podVolume identifies an inline volume in a pod spec
+type podVolume struct {
+	Namespace string
+	Name      string
+	Volume    string
+}
+
+// publishedTarget is a bind mount of a staged volume
+type publishedTarget struct {
+	// SourcePath is either the staging path or the path of a separate mount for MountGroup
+	SourcePath string
+	MountGroup string
+	// SubPath is the directory of the volume bound to the target, relative to SourcePath
+	SubPath string `json:",omitempty"`
+	Options []string
+}
+
+type volumeUsage struct {
+	bytes      int64
+	objects    int64
+	updated    time.Time
+	checked    time.Time
+	refreshing bool
+}
+
+// capacity returns the requested capacity of the volume, 0 if unknown
+func (vol *stagedVolume) capacity() int64 {
+	capacity, _ := strconv.ParseInt(vol.VolumeContext["capacity"], 10, 64)
+	return capacity
+}
+
+// volumeRegistry tracks volumes staged on the node by their staging path.
+// If statePath is set, the registry is saved to it on every change, so that
+// the node plugin can restore mounts of the volumes after a restart
+type volumeRegistry struct {
+	mu        sync.Mutex
+	volumes   map[string]*stagedVolume
+	statePath string
+}
+
+func newVolumeRegistry(statePath string) *volumeRegistry {
+	return &volumeRegistry{
+		volumes:   make(map[string]*stagedVolume),
+		statePath: statePath,
+	}
+}
+
+// load reads volumes staged before the restart of the node plugin from the state file
+func (r *volumeRegistry) load() error {
+	if r.statePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(r.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var volumes []*stagedVolume
+	if err := json.Unmarshal(data, &volumes); err != nil {
+		return fmt.Errorf("failed to parse %v: %v", r.statePath, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, vol := range volumes {
+		if vol.Targets == nil {
+			vol.Targets = make(map[string]*publishedTarget)
+		}
+		vol.health = make(map[string]*mountHealth)
+		r.volumes[vol.StagingPath] = vol
+	}
+	return nil
+}
+
+// save writes the registry to the state file, it must be called with the lock held
+func (r *volumeRegistry) save() {
+	if r.statePath == "" {
+		return
+	}
+	volumes := make([]*stagedVolume, 0, len(r.volumes))
+	for _, vol := range r.volumes {
+		volumes = append(volumes, vol)
+	}
+	data, err := json.Marshal(volumes)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(r.statePath), 0750)
+	}
+	if err == nil {
+		// write to a temporary file first to not lose the state on a crash
+		tmpPath := r.statePath + ".tmp"
+		err = os.WriteFile(tmpPath, data, 0600)
+		if err == nil {
+			err = os.Rename(tmpPath, r.statePath)
+		}
+	}
+	if err != nil {
+		klog.ErrorS(err, "Failed to save the state of staged volumes", "path", r.statePath)
+	}
+}
+
+// add registers the volume or updates its context and secrets if it's already registered
+func (r *volumeRegistry) add(volumeID, stagingPath string, readOnly bool, mountGroup string, volumeContext, secrets map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol, ok := r.volumes[stagingPath]
+	if !ok || vol.VolumeID != volumeID {
+		vol = &stagedVolume{
+			VolumeID:    volumeID,
+			StagingPath: stagingPath,
+			ReadOnly:    readOnly,
+			MountGroup:  mountGroup,
+			Targets:     make(map[string]*publishedTarget),
+			health:      make(map[string]*mountHealth),
+		}
+		r.volumes[stagingPath] = vol
+	}
+	vol.VolumeContext = volumeContext
+	if len(secrets) > 0 {
+		vol.secrets = secrets
+	}
+	if hash := credentialsHash(secrets); hash != "" {
+		vol.CredentialsHash = hash
+	}
+	if pvName := volumeContext[pvNameKey]; pvName != "" {
+		vol.PVName = pvName
+	}
+	if isEphemeral(volumeContext) {
+		vol.Ephemeral = true
+		if volumeContext[podNameKey] != "" {
+			vol.Pod = &podVolume{
+				Namespace: volumeContext[podNamespaceKey],
+				Name:      volumeContext[podNameKey],
+				// target path is .../pods/<uid>/volumes/kubernetes.io~csi/<volume>/mount
+				Volume: filepath.Base(filepath.Dir(stagingPath)),
+			}
+		}
+	}
+	r.save()
+}
+
+// addTarget registers a bind mount of the volume. pvName is the name of the PersistentVolume
+// if it's known from the target path
+func (r *volumeRegistry) addTarget(stagingPath, targetPath, pvName string, target *publishedTarget) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol, ok := r.volumes[stagingPath]; ok {
+		vol.Targets[targetPath] = target
+		if vol.PVName == "" {
+			vol.PVName = pvName
+		}
+		r.save()
+	}
+}
+
+func (r *volumeRegistry) removeTarget(volumeID, targetPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, vol := range r.volumes {
+		if vol.VolumeID == volumeID {
+			delete(vol.Targets, targetPath)
+		}
+	}
+	r.save()
+}
+
+// remove forgets the volume and returns it, nil if it's unknown
+func (r *volumeRegistry) remove(stagingPath string) *stagedVolume {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol := r.volumes[stagingPath]
+	delete(r.volumes, stagingPath)
+	r.save()
+	return vol
+}
+
+// count returns the number of staged volumes
+func (r *volumeRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.volumes)
+}
+
+// setSecrets remembers secrets of the volume fetched from the Kubernetes API
+func (r *volumeRegistry) setSecrets(stagingPath string, secrets map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol, ok := r.volumes[stagingPath]; ok {
+		vol.secrets = secrets
+		if hash := credentialsHash(secrets); hash != "" && hash != vol.CredentialsHash {
+			vol.CredentialsHash = hash
+			r.save()
+		}
+	}
+}
+
+// secretSource returns the PersistentVolume or the pod referencing secrets of the volume, if known
+func (r *volumeRegistry) secretSource(stagingPath string) (string, *podVolume) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol, ok := r.volumes[stagingPath]; ok {
+		return vol.PVName, vol.Pod
+	}
+	return "", nil
+}
+
+// volumeSecrets returns secrets of the volume, if they are known since the start of the node plugin
+func (r *volumeRegistry) volumeSecrets(stagingPath string) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vol, ok := r.volumes[stagingPath]; ok {
+		return vol.secrets
+	}
+	return nil
+}
+
+// removeStale forgets volumes and bind mounts whose directories were removed by kubelet
+// while the node plugin was not running, and returns the removed volumes
+func (r *volumeRegistry) removeStale() []*stagedVolume {
+	r.mu.Lock()
+	var paths []string
+	for stagingPath, vol := range r.volumes {
+		paths = append(paths, stagingPath)
+		for targetPath := range vol.Targets {
+			paths = append(paths, targetPath)
+		}
+	}
+	r.mu.Unlock()
+	exists := make(map[string]bool)
+	for _, path := range paths {
+		exists[path] = entryExists(path)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var stale []*stagedVolume
+	for stagingPath, vol := range r.volumes {
+		if e, ok := exists[stagingPath]; ok && !e {
+			delete(r.volumes, stagingPath)
+			stale = append(stale, vol)
+			continue
+		}
+		for targetPath := range vol.Targets {
+			if e, ok := exists[targetPath]; ok && !e {
+				delete(vol.Targets, targetPath)
+			}
+		}
+	}
+	r.save()
+	return stale
+}
+
+// entryExists checks if the path exists by listing its parent directory,
+// so it doesn't hang when the path is a mount point of a hung FUSE daemon
+func entryExists(path string) bool {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Name() == filepath.Base(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the volume staged in stagingPath or, if it's empty, any staged volume with this ID
+func (r *volumeRegistry) find(volumeID, stagingPath string) *stagedVolume {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if stagingPath != "" {
+		if vol, ok := r.volumes[stagingPath]; ok && vol.VolumeID == volumeID {
+			return vol
+		}
+		return nil
+	}
+	for _, vol := range r.volumes {
+		if vol.VolumeID == volumeID {
+			return vol
+		}
+	}
+	return nil
+}
+
+// mountPath returns the FUSE mount of the volume serving the volume path, which is either
+// a target path or the staging path, and the memory limit of its daemon
+func (r *volumeRegistry) mountPath(vol *stagedVolume, volumePath string) (string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if target, ok := vol.Targets[volumePath]; ok {
+		return target.SourcePath, volumeMemoryLimit(vol.VolumeContext)
+	}
+	return vol.StagingPath, volumeMemoryLimit(vol.VolumeContext)
+}
+
+// getUsage returns the requested capacity of the volume and the last known number of bytes
+// stored in it. Outdated usage is refreshed in background and ok is false until the first
+// refresh finishes. Usage is not calculated for volumes without capacity
+func (r *volumeRegistry) getUsage(vol *stagedVolume) (capacity int64, used int64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	capacity = vol.capacity()
+	if capacity <= 0 {
+		return 0, 0, false
+	}
+	usage := &vol.usage
+	if !usage.refreshing && time.Since(usage.checked) > usageRefreshInterval && len(vol.secrets) > 0 {
+		usage.refreshing = true
+		usage.checked = time.Now()
+		go r.refreshUsage(vol, maps.Clone(vol.VolumeContext), vol.secrets)
+	}
+	return capacity, usage.bytes, !usage.updated.IsZero()
+}
+
+// refreshUsage lists objects of the volume. Its context is copied by the caller under the lock,
+// as the volume may be staged again with another context meanwhile
+func (r *volumeRegistry) refreshUsage(vol *stagedVolume, volumeContext, secrets map[string]string) {
+	// The usage is refreshed in the background, independently of the request which has triggered it
+	bytes, objects, err := listUsage(context.Background(), vol.VolumeID, volumeContext, secrets)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	vol.usage.refreshing = false
+	if err != nil {
+		klog.ErrorS(err, "Failed to calculate usage of volume", "volumeID", vol.VolumeID)
+		return
+	}
+	vol.usage.bytes = bytes
+	vol.usage.objects = objects
+	vol.usage.updated = time.Now()
+}
+
+// listUsage returns the size and number of objects of the volume, replaced in tests
+var listUsage = listObjectsUsage
+
+func listObjectsUsage(ctx context.Context, volumeID string, volumeContext, secrets map[string]string) (int64, int64, error) {
+	client, err := s3.NewClientFromSecret(ctx, volumeSecrets(secrets, volumeContext))
+	if err != nil {
+		return 0, 0, err
+	}
+	bucketName, prefix := volumeBucketPrefix(volumeID, volumeContext)
+	return client.GetUsage(bucketName, prefix)
+}
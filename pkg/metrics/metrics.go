@@ -0,0 +1,178 @@
+// Package metrics exports Prometheus metrics of the driver
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "csi_s3"
+
+var (
+	registry = prometheus.NewRegistry()
+
+	grpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "grpc_requests_total",
+		Help:      "Number of CSI gRPC calls by method and status code.",
+	}, []string{"method", "code"})
+	grpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Duration of CSI gRPC calls by method.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"method"})
+
+	s3Operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_operations_total",
+		Help:      "Number of S3 operations by operation and result, retries are not counted separately.",
+	}, []string{"operation", "result"})
+	s3Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_retries_total",
+		Help:      "Number of retries of S3 operations failed with transient errors.",
+	}, []string{"operation"})
+
+	mountDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mount_duration_seconds",
+		Help:      "Duration of FUSE mounts and unmounts by mounter and operation.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"mounter", "operation"})
+	mountFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mount_failures_total",
+		Help:      "Number of failed FUSE mounts and unmounts by mounter and operation.",
+	}, []string{"mounter", "operation"})
+)
+
+// Operations of mount metrics
+const (
+	OperationMount   = "mount"
+	OperationUnmount = "unmount"
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		grpcRequests, grpcDuration,
+		s3Operations, s3Retries,
+		mountDuration, mountFailures,
+	)
+}
+
+// RegisterGauge exports a gauge whose value is read from fn on every scrape
+func RegisterGauge(name, help string, fn func() float64) {
+	err := registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+	if err != nil {
+		klog.ErrorS(err, "Failed to register metric", "metric", name)
+	}
+}
+
+// Serve exports metrics over HTTP on the address until the process exits
+func Serve(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	klog.InfoS("Serving metrics", "address", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		klog.ErrorS(err, "Failed to serve metrics", "address", address)
+	}
+}
+
+// UnaryServerInterceptor counts CSI gRPC calls and measures their duration
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// S3Operation counts a finished S3 operation
+func S3Operation(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	s3Operations.WithLabelValues(operation, result).Inc()
+}
+
+// S3Retry counts a retry of an S3 operation
+func S3Retry(operation string) {
+	s3Retries.WithLabelValues(operation).Inc()
+}
+
+// MountOperation measures a finished mount or unmount of a FUSE daemon of the mounter
+func MountOperation(mounter, operation string, start time.Time, err error) {
+	mountDuration.WithLabelValues(mounter, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		mountFailures.WithLabelValues(mounter, operation).Inc()
+	}
+}
+
+// VolumeDaemon is resource usage of the FUSE daemon of a volume mount
+type VolumeDaemon struct {
+	VolumeID  string
+	PVC       string
+	Namespace string
+	Path      string
+	// CPUSeconds is the total CPU time used by the daemon since it has started
+	CPUSeconds float64
+	RSSBytes   int64
+	// MemoryLimit is 0 if the daemon is not limited
+	MemoryLimit int64
+	Restarts    int64
+}
+
+var (
+	volumeLabels     = []string{"volume_id", "pvc", "namespace", "path"}
+	fuseCPUDesc      = prometheus.NewDesc(namespace+"_fuse_cpu_seconds_total", "CPU time used by the FUSE daemon of a volume mount.", volumeLabels, nil)
+	fuseRSSDesc      = prometheus.NewDesc(namespace+"_fuse_memory_bytes", "Memory used by the FUSE daemon of a volume mount.", volumeLabels, nil)
+	fuseLimitDesc    = prometheus.NewDesc(namespace+"_fuse_memory_limit_bytes", "Memory limit of the FUSE daemon of a volume mount.", volumeLabels, nil)
+	fuseRestartsDesc = prometheus.NewDesc(namespace+"_fuse_restarts_total", "Restarts of the FUSE daemon of a volume mount by systemd or the mount monitor.", volumeLabels, nil)
+)
+
+// volumeDaemonCollector reads resource usage of FUSE daemons on every scrape
+type volumeDaemonCollector struct {
+	daemons func() []VolumeDaemon
+}
+
+func (c volumeDaemonCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- fuseCPUDesc
+	ch <- fuseRSSDesc
+	ch <- fuseLimitDesc
+	ch <- fuseRestartsDesc
+}
+
+func (c volumeDaemonCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, d := range c.daemons() {
+		labels := []string{d.VolumeID, d.PVC, d.Namespace, d.Path}
+		ch <- prometheus.MustNewConstMetric(fuseCPUDesc, prometheus.CounterValue, d.CPUSeconds, labels...)
+		ch <- prometheus.MustNewConstMetric(fuseRSSDesc, prometheus.GaugeValue, float64(d.RSSBytes), labels...)
+		if d.MemoryLimit > 0 {
+			ch <- prometheus.MustNewConstMetric(fuseLimitDesc, prometheus.GaugeValue, float64(d.MemoryLimit), labels...)
+		}
+		ch <- prometheus.MustNewConstMetric(fuseRestartsDesc, prometheus.CounterValue, float64(d.Restarts), labels...)
+	}
+}
+
+// RegisterVolumeDaemons exports resource usage of FUSE daemons returned by fn on every scrape
+func RegisterVolumeDaemons(fn func() []VolumeDaemon) {
+	if err := registry.Register(volumeDaemonCollector{daemons: fn}); err != nil {
+		klog.ErrorS(err, "Failed to register FUSE daemon metrics")
+	}
+}
@@ -0,0 +1,171 @@
+package mounter
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Dynamically linked FUSE daemons are copied here with their libraries
+	bundleLibDir = "lib"
+	// Helper binaries of FUSE daemons, like fusermount, are put here and added to PATH of their units
+	bundleBinDir = "bin"
+)
+
+// Directories searched for shared libraries after RPATH and RUNPATH, like the dynamic loader does
+var libraryDirs = []string{
+	"/lib", "/usr/lib", "/lib64", "/usr/lib64", "/usr/local/lib",
+	"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu",
+	"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu",
+}
+
+// bundleMu serializes copying binaries to the plugin directory by concurrent mounts
+var bundleMu sync.Mutex
+
+// hostCommand copies the binary from the container to the plugin directory and returns the command
+// starting it on the host. Static binaries are copied as is, like GeeseFS. Dynamically linked ones,
+// like s3fs and rclone of Alpine, are copied with the dynamic loader and all shared libraries of the
+// container and started by that loader, so that they don't depend on libraries of the host
+func hostCommand(binary, name string) ([]string, error) {
+	bundleMu.Lock()
+	defer bundleMu.Unlock()
+	return copyToHost(binary, name)
+}
+
+func copyToHost(binary, name string) ([]string, error) {
+	interp, err := elfInterpreter(binary)
+	if err != nil {
+		return nil, err
+	}
+	if interp == "" {
+		if err := copyBinary(binary, containerPluginDir+"/"+name); err != nil {
+			return nil, err
+		}
+		return []string{hostPluginDir() + "/" + name}, nil
+	}
+	libs, err := sharedLibraries(binary)
+	if err != nil {
+		return nil, err
+	}
+	libDir := containerPluginDir + "/" + bundleLibDir
+	if err := os.MkdirAll(libDir, 0755); err != nil {
+		return nil, err
+	}
+	libs[filepath.Base(interp)] = interp
+	for soname, path := range libs {
+		if err := copyBinary(path, libDir+"/"+soname); err != nil {
+			return nil, err
+		}
+	}
+	if err := copyBinary(binary, libDir+"/"+name); err != nil {
+		return nil, err
+	}
+	hostLibDir := hostPluginDir() + "/" + bundleLibDir
+	return []string{
+		hostLibDir + "/" + filepath.Base(interp),
+		"--library-path", hostLibDir,
+		hostLibDir + "/" + name,
+	}, nil
+}
+
+// hostHelpers makes helper binaries of a FUSE daemon available on the host and returns the directory
+// to add to its PATH. Helpers missing in the container are skipped, the ones of the host are used then
+func hostHelpers(helpers []string) (string, error) {
+	bundleMu.Lock()
+	defer bundleMu.Unlock()
+	binDir := containerPluginDir + "/" + bundleBinDir
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		return "", err
+	}
+	for _, helper := range helpers {
+		if _, err := os.Stat(helper); os.IsNotExist(err) {
+			continue
+		}
+		name := filepath.Base(helper)
+		command, err := copyToHost(helper, name)
+		if err != nil {
+			return "", fmt.Errorf("failed to copy %s to the host: %v", helper, err)
+		}
+		script := "#!/bin/sh\nexec '" + strings.Join(command, "' '") + "' \"$@\"\n"
+		if err := os.WriteFile(binDir+"/"+name, []byte(script), 0755); err != nil {
+			return "", err
+		}
+	}
+	return hostPluginDir() + "/" + bundleBinDir, nil
+}
+
+// elfInterpreter returns the dynamic loader of the binary, empty if it's static
+func elfInterpreter(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			data := make([]byte, prog.Filesz)
+			if _, err := prog.ReadAt(data, 0); err != nil {
+				return "", fmt.Errorf("failed to read the interpreter of %s: %v", path, err)
+			}
+			return strings.TrimRight(string(data), "\x00"), nil
+		}
+	}
+	return "", nil
+}
+
+// sharedLibraries returns paths of all shared libraries the binary depends on, directly or through
+// other libraries, by the names it references them with
+func sharedLibraries(binary string) (map[string]string, error) {
+	libs := make(map[string]string)
+	queue := []string{binary}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		f, err := elf.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		needed, err := f.ImportedLibraries()
+		var dirs []string
+		for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+			values, _ := f.DynString(tag)
+			for _, value := range values {
+				dirs = append(dirs, filepath.SplitList(value)...)
+			}
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read libraries of %s: %v", path, err)
+		}
+		dirs = append(dirs, libraryDirs...)
+		for _, name := range needed {
+			if _, ok := libs[name]; ok {
+				continue
+			}
+			lib := findLibrary(name, dirs)
+			if lib == "" {
+				return nil, fmt.Errorf("library %s of %s is not found", name, path)
+			}
+			libs[name] = lib
+			queue = append(queue, lib)
+		}
+	}
+	return libs, nil
+}
+
+func findLibrary(name string, dirs []string) string {
+	for _, dir := range dirs {
+		if strings.Contains(dir, "$ORIGIN") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
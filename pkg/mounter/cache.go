@@ -0,0 +1,160 @@
+package mounter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+const (
+	CacheModeOff     = "off"
+	CacheModeMinimal = "minimal"
+	CacheModeWrites  = "writes"
+	CacheModeFull    = "full"
+
+	cacheReservationSuffix = ".size"
+)
+
+// CacheModes lists valid values of the cacheMode volume attribute
+var CacheModes = []string{CacheModeOff, CacheModeMinimal, CacheModeWrites, CacheModeFull}
+
+// CacheConfig configures local disk caches of FUSE daemons
+type CacheConfig struct {
+	// Root is the directory for caches of all mounts. Outside of the plugin directory,
+	// it must be mounted into the plugin container at the same path as on the host
+	Root string
+	// Budget is the total size of caches on the node in bytes, 0 means unlimited
+	Budget int64
+	// DefaultSize is charged to the budget for caches of volumes without cacheSize
+	DefaultSize int64
+}
+
+var (
+	DefaultCache = CacheConfig{
+		Root:        containerPluginDir + "/cache",
+		DefaultSize: 1 << 30,
+	}
+
+	// ErrCacheBudgetExceeded is returned when the cache of a mount doesn't fit into the node budget
+	ErrCacheBudgetExceeded = errors.New("node cache budget exceeded")
+
+	cacheMu sync.Mutex
+)
+
+// cacheDir is the cache directory of a single mount
+type cacheDir struct {
+	ContainerPath string
+	HostPath      string
+	Size          int64
+}
+
+// cacheEnabled returns true if the volume uses a disk cache. rclone caches writes by default
+func cacheEnabled(meta *s3.FSMeta, mounterType string) bool {
+	switch meta.CacheMode {
+	case CacheModeOff:
+		return false
+	case "":
+		return meta.CacheSize > 0 || mounterType == rcloneMounterType
+	}
+	return true
+}
+
+// prepareVolumeCache prepares the cache directory of the mount if the volume uses a disk cache, otherwise returns nil
+func prepareVolumeCache(target string, meta *s3.FSMeta, mounterType string) (*cacheDir, error) {
+	if !cacheEnabled(meta, mounterType) {
+		return nil, nil
+	}
+	return prepareCache(target, meta.CacheSize)
+}
+
+// hostPath returns the path of a file in the container on the host
+func hostPath(path string) string {
+	if path == containerPluginDir || strings.HasPrefix(path, containerPluginDir+"/") {
+		return hostPluginDir() + strings.TrimPrefix(path, containerPluginDir)
+	}
+	return path
+}
+
+// prepareCache creates the cache directory of the mount in target and reserves its size in the node budget
+func prepareCache(target string, size int64) (*cacheDir, error) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	root := DefaultCache.Root
+	// GeeseFS drops root privileges, so it must be able to reach its cache directory
+	if err := os.MkdirAll(root, 0711); err != nil {
+		return nil, fmt.Errorf("Error creating directory %s: %v", root, err)
+	}
+	name := mountPathHash(target)
+	if DefaultCache.Budget > 0 {
+		if size <= 0 {
+			// rclone caches writes by default, so volumes without a size are charged the default one
+			size = DefaultCache.DefaultSize
+		}
+		if size <= 0 {
+			return nil, fmt.Errorf("%w: cache size of the volume is not set", ErrCacheBudgetExceeded)
+		}
+		reserved, err := reservedCache(root, name)
+		if err != nil {
+			return nil, err
+		}
+		if reserved+size > DefaultCache.Budget {
+			return nil, fmt.Errorf("%w: %d bytes are reserved of %d, %d more are requested",
+				ErrCacheBudgetExceeded, reserved, DefaultCache.Budget, size)
+		}
+	}
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating directory %s: %v", path, err)
+	}
+	// the reservation is kept on disk to survive restarts of the node plugin
+	if err := os.WriteFile(path+cacheReservationSuffix, []byte(strconv.FormatInt(size, 10)), 0600); err != nil {
+		return nil, fmt.Errorf("Error writing %s: %v", path+cacheReservationSuffix, err)
+	}
+	return &cacheDir{
+		ContainerPath: path,
+		HostPath:      hostPath(path),
+		Size:          size,
+	}, nil
+}
+
+// reservedCache returns the total size of caches reserved by all mounts except the given one
+func reservedCache(root, except string) (int64, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), cacheReservationSuffix)
+		if !ok || name == except {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, e.Name()))
+		if err != nil {
+			return 0, err
+		}
+		size, _ := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		total += size
+	}
+	return total, nil
+}
+
+// RemoveCache deletes the cache of the mount in target and releases its reservation
+func RemoveCache(target string) error {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	path := filepath.Join(DefaultCache.Root, mountPathHash(target))
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if err := os.Remove(path + cacheReservationSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
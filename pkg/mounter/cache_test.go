@@ -0,0 +1,132 @@
+package mounter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+// fakeCacheRoot points DefaultCache to a temporary root with the given budget
+func fakeCacheRoot(t *testing.T, budget, defaultSize int64) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "cache")
+	oldCache := DefaultCache
+	DefaultCache = CacheConfig{Root: root, Budget: budget, DefaultSize: defaultSize}
+	t.Cleanup(func() { DefaultCache = oldCache })
+	return root
+}
+
+func TestCacheEnabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		meta        s3.FSMeta
+		mounterType string
+		want        bool
+	}{
+		{"geesefs without cache", s3.FSMeta{}, geesefsMounterType, false},
+		{"geesefs with size", s3.FSMeta{CacheSize: 1 << 20}, geesefsMounterType, true},
+		{"geesefs with mode", s3.FSMeta{CacheMode: CacheModeFull}, geesefsMounterType, true},
+		{"rclone by default", s3.FSMeta{}, rcloneMounterType, true},
+		{"rclone with cache off", s3.FSMeta{CacheMode: CacheModeOff}, rcloneMounterType, false},
+		{"size with cache off", s3.FSMeta{CacheMode: CacheModeOff, CacheSize: 1 << 20}, s3fsMounterType, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cacheEnabled(&tt.meta, tt.mounterType); got != tt.want {
+				t.Errorf("cacheEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareCacheBudget(t *testing.T) {
+	root := fakeCacheRoot(t, 1000, 300)
+
+	a, err := prepareCache("/mnt/a", 600)
+	if err != nil {
+		t.Fatalf("prepareCache within the budget failed: %v", err)
+	}
+	if a.Size != 600 || a.ContainerPath != filepath.Join(root, mountPathHash("/mnt/a")) {
+		t.Errorf("prepareCache() = %+v, want 600 bytes in the root", a)
+	}
+	if st, err := os.Stat(a.ContainerPath); err != nil || !st.IsDir() {
+		t.Errorf("cache directory %v is not created: %v", a.ContainerPath, err)
+	}
+
+	// volumes without cacheSize are charged the default size
+	b, err := prepareCache("/mnt/b", 0)
+	if err != nil {
+		t.Fatalf("prepareCache with the default size failed: %v", err)
+	}
+	if b.Size != 300 {
+		t.Errorf("prepareCache() charged %d bytes, want the default 300", b.Size)
+	}
+	if reserved, err := reservedCache(root, ""); err != nil || reserved != 900 {
+		t.Errorf("reservedCache() = %d, %v, want 900", reserved, err)
+	}
+
+	if _, err := prepareCache("/mnt/c", 200); !errors.Is(err, ErrCacheBudgetExceeded) {
+		t.Errorf("prepareCache over the budget returned %v, want ErrCacheBudgetExceeded", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, mountPathHash("/mnt/c"))); !os.IsNotExist(err) {
+		t.Errorf("cache directory of a rejected mount is created")
+	}
+
+	// the mount itself is excluded from the budget, so it may be prepared again with another size
+	if _, err := prepareCache("/mnt/a", 700); err != nil {
+		t.Errorf("prepareCache of the same mount with a new size failed: %v", err)
+	}
+	if reserved, err := reservedCache(root, ""); err != nil || reserved != 1000 {
+		t.Errorf("reservedCache() = %d, %v, want 1000", reserved, err)
+	}
+}
+
+func TestPrepareCacheWithoutBudget(t *testing.T) {
+	fakeCacheRoot(t, 0, 300)
+	cache, err := prepareCache("/mnt/a", 0)
+	if err != nil {
+		t.Fatalf("prepareCache without budget failed: %v", err)
+	}
+	if cache.Size != 0 {
+		t.Errorf("prepareCache() charged %d bytes without a budget, want 0", cache.Size)
+	}
+}
+
+func TestPrepareCacheWithoutDefaultSize(t *testing.T) {
+	fakeCacheRoot(t, 1000, 0)
+	if _, err := prepareCache("/mnt/a", 0); !errors.Is(err, ErrCacheBudgetExceeded) {
+		t.Errorf("prepareCache without any size returned %v, want ErrCacheBudgetExceeded", err)
+	}
+}
+
+func TestRemoveCacheAfterFailedMount(t *testing.T) {
+	root := fakeCacheRoot(t, 1000, 300)
+	cache, err := prepareCache("/mnt/a", 800)
+	if err != nil {
+		t.Fatalf("prepareCache failed: %v", err)
+	}
+	// the daemon may have written to the cache before failing
+	if err := os.WriteFile(filepath.Join(cache.ContainerPath, "chunk"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := prepareCache("/mnt/b", 800); !errors.Is(err, ErrCacheBudgetExceeded) {
+		t.Fatalf("prepareCache over the budget returned %v, want ErrCacheBudgetExceeded", err)
+	}
+
+	if err := RemoveCache("/mnt/a"); err != nil {
+		t.Fatalf("RemoveCache failed: %v", err)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("cache root contains %v after RemoveCache", entries)
+	}
+	if _, err := prepareCache("/mnt/b", 800); err != nil {
+		t.Errorf("prepareCache after the reservation is released failed: %v", err)
+	}
+	if err := RemoveCache("/mnt/unknown"); err != nil {
+		t.Errorf("RemoveCache of a mount without cache failed: %v", err)
+	}
+}
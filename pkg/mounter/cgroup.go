@@ -0,0 +1,136 @@
+package mounter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// cgroupDriverLeaf is the cgroup processes of the plugin container are moved to, as cgroup v2
+	// only distributes resources to children of cgroups without processes
+	cgroupDriverLeaf = "csi-s3-driver"
+	// cgroupFusePrefix starts names of cgroups of FUSE daemons started inside the plugin container
+	cgroupFusePrefix = "csi-s3-fuse-"
+	// cgroupCPUPeriod is the period of cpu.max of FUSE daemons in microseconds
+	cgroupCPUPeriod = 100000
+)
+
+var (
+	// cgroupRoot is the cgroup v2 hierarchy of the plugin container
+	cgroupRoot = "/sys/fs/cgroup"
+
+	cgroupOnce sync.Once
+	cgroupErr  error
+)
+
+// setupCgroups delegates the memory and cpu controllers of the cgroup of the plugin container to
+// cgroups of FUSE daemons started inside it, once. It fails with cgroup v1 or a read-only hierarchy
+func setupCgroups() error {
+	cgroupOnce.Do(func() {
+		cgroupErr = delegateControllers(cgroupRoot)
+	})
+	return cgroupErr
+}
+
+func delegateControllers(root string) error {
+	data, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("cgroup v2 is not available: %v", err)
+	}
+	controllers := strings.Fields(string(data))
+	for _, controller := range []string{"memory", "cpu"} {
+		if !slices.Contains(controllers, controller) {
+			return fmt.Errorf("%s controller is not available in %s", controller, root)
+		}
+	}
+	leaf := filepath.Join(root, cgroupDriverLeaf)
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return fmt.Errorf("failed to create cgroup %s: %v", leaf, err)
+	}
+	data, err = os.ReadFile(filepath.Join(root, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, pid := range strings.Fields(string(data)) {
+		err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("failed to move process %s to cgroup %s: %v", pid, leaf, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+		return fmt.Errorf("failed to enable memory and cpu controllers in %s: %v", root, err)
+	}
+	return nil
+}
+
+// directCgroup creates the cgroup of the FUSE daemon mounting target inside the plugin container with
+// the limits applied. It returns the opened cgroup directory to start the daemon in, the caller closes it
+func (l Limits) directCgroup(target string) (*os.File, error) {
+	if err := setupCgroups(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLimitsUnsupported, err)
+	}
+	path := filepath.Join(cgroupRoot, cgroupFusePrefix+mountPathHash(target))
+	if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("%w: failed to create cgroup %s: %v", ErrLimitsUnsupported, path, err)
+	}
+	memoryMax := "max"
+	if l.MemoryMax > 0 {
+		memoryMax = strconv.FormatInt(l.MemoryMax, 10)
+	}
+	cpuMax := fmt.Sprintf("max %d", cgroupCPUPeriod)
+	if l.CPUMillicores > 0 {
+		cpuMax = fmt.Sprintf("%d %d", l.CPUMillicores*cgroupCPUPeriod/1000, cgroupCPUPeriod)
+	}
+	for file, value := range map[string]string{"memory.max": memoryMax, "cpu.max": cpuMax} {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+			return nil, fmt.Errorf("%w: failed to set %s of %s: %v", ErrLimitsUnsupported, file, path, err)
+		}
+	}
+	return os.Open(path)
+}
+
+// RemoveCgroup removes the cgroup of the FUSE daemon of the mount in target started inside the plugin
+// container, if any. It fails while the daemon is still running
+func RemoveCgroup(target string) error {
+	err := os.Remove(filepath.Join(cgroupRoot, cgroupFusePrefix+mountPathHash(target)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CheckDefaultLimits fails if default limits of FUSE daemons can't be enforced on the node. They are
+// applied by systemd or mounter pods, and by cgroups of the plugin container for daemons started
+// inside it. Without systemd every daemon is started inside the container, so a node which can't
+// create cgroups there can't enforce the limits at all
+func CheckDefaultLimits(ctx context.Context) error {
+	if Pods != nil || (DefaultLimits.MemoryMax <= 0 && DefaultLimits.CPUMillicores <= 0) {
+		return nil
+	}
+	err := setupCgroups()
+	if err == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	conn, connErr := systemd.NewWithContext(ctx)
+	if connErr != nil {
+		return fmt.Errorf("FUSE daemon limits can't be enforced: systemd is unreachable (%v) and %v", connErr, err)
+	}
+	conn.Close()
+	klog.FromContext(ctx).Error(err, "FUSE daemon limits can't be enforced inside the plugin container, "+
+		"volumes with --no-systemd will fail to mount")
+	return nil
+}
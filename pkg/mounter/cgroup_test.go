@@ -0,0 +1,97 @@
+package mounter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// fakeCgroupRoot points cgroupRoot to a directory mimicking a cgroup v2 hierarchy
+func fakeCgroupRoot(t *testing.T, controllers string) string {
+	t.Helper()
+	root := t.TempDir()
+	for file, data := range map[string]string{
+		"cgroup.controllers":     controllers,
+		"cgroup.procs":           "1\n42\n",
+		"cgroup.subtree_control": "",
+	} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldRoot := cgroupRoot
+	cgroupRoot = root
+	cgroupOnce, cgroupErr = sync.Once{}, nil
+	t.Cleanup(func() {
+		cgroupRoot = oldRoot
+		cgroupOnce, cgroupErr = sync.Once{}, nil
+	})
+	return root
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDirectCgroup(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     Limits
+		wantMemory string
+		wantCPU    string
+	}{
+		{"memory and CPU", Limits{MemoryMax: 512 << 20, CPUMillicores: 500}, "536870912", "50000 100000"},
+		{"memory only", Limits{MemoryMax: 1 << 30}, "1073741824", "max 100000"},
+		{"CPU only", Limits{CPUMillicores: 2000}, "max", "200000 100000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := fakeCgroupRoot(t, "cpuset cpu io memory pids")
+			dir, err := tt.limits.directCgroup("/mnt/target")
+			if err != nil {
+				t.Fatalf("directCgroup failed: %v", err)
+			}
+			dir.Close()
+			if got := readFile(t, filepath.Join(root, "cgroup.subtree_control")); got != "+memory +cpu" {
+				t.Errorf("cgroup.subtree_control = %q, want +memory +cpu", got)
+			}
+			if got := readFile(t, filepath.Join(root, cgroupDriverLeaf, "cgroup.procs")); got != "42" {
+				t.Errorf("last process moved to the driver cgroup = %q, want 42", got)
+			}
+			path := filepath.Join(root, cgroupFusePrefix+mountPathHash("/mnt/target"))
+			if got := readFile(t, filepath.Join(path, "memory.max")); got != tt.wantMemory {
+				t.Errorf("memory.max = %q, want %q", got, tt.wantMemory)
+			}
+			if got := readFile(t, filepath.Join(path, "cpu.max")); got != tt.wantCPU {
+				t.Errorf("cpu.max = %q, want %q", got, tt.wantCPU)
+			}
+			for _, file := range []string{"memory.max", "cpu.max"} {
+				os.Remove(filepath.Join(path, file))
+			}
+			if err := RemoveCgroup("/mnt/target"); err != nil {
+				t.Errorf("RemoveCgroup failed: %v", err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("cgroup %s is left after RemoveCgroup", path)
+			}
+		})
+	}
+}
+
+func TestDirectCgroupUnsupported(t *testing.T) {
+	fakeCgroupRoot(t, "cpuset io pids")
+	_, err := Limits{MemoryMax: 1 << 30}.directCgroup("/mnt/target")
+	if !errors.Is(err, ErrLimitsUnsupported) {
+		t.Errorf("directCgroup without the memory controller returned %v, want ErrLimitsUnsupported", err)
+	}
+	if err := RemoveCgroup("/mnt/target"); err != nil {
+		t.Errorf("RemoveCgroup of a missing cgroup failed: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+const (
+	credentialsDir = "credentials"
+)
+
+// credentialsFile is a file with S3 credentials of a single mount in the plugin directory.
+// Credentials are never passed in arguments, environments or systemd unit properties
+// of FUSE daemons, because all of them are visible to any user of the host
+type credentialsFile struct {
+	// ContainerPath is the path of the file inside the plugin container
+	ContainerPath string
+	// HostPath is the path of the same file on the host, used by systemd units
+	HostPath string
+}
+
+// writeCredentials saves credentials of the mount in target to a file readable only by root
+func writeCredentials(target, content string) (*credentialsFile, error) {
+	dir := filepath.Join(containerPluginDir, credentialsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Error creating directory %s: %v", dir, err)
+	}
+	name := mountPathHash(target)
+	path := filepath.Join(dir, name)
+	// write to a temporary file first to not leave a partially written file
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(content), 0600); err != nil {
+		return nil, fmt.Errorf("Error writing credentials file %s: %v", tmpPath, err)
+	}
+	// WriteFile doesn't change permissions of an existing file
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return nil, fmt.Errorf("Error writing credentials file %s: %v", path, err)
+	}
+	return &credentialsFile{
+		ContainerPath: path,
+		HostPath:      filepath.Join(hostPluginDir(), credentialsDir, name),
+	}, nil
+}
+
+// awsCredentials formats credentials as an AWS shared credentials file
+func awsCredentials(accessKeyID, secretAccessKey string) string {
+	return fmt.Sprintf("[default]\naws_access_key_id = %s\naws_secret_access_key = %s\n", accessKeyID, secretAccessKey)
+}
+
+// RemoveCredentials removes the credentials file of the mount in target
+func RemoveCredentials(target string) error {
+	err := os.Remove(filepath.Join(containerPluginDir, credentialsDir, mountPathHash(target)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// UpdateCredentials rewrites the credentials file of the running mount in target with the credentials
+// of cfg. It returns true if the FUSE daemon picks them up without a restart: GeeseFS and rclone read
+// the shared credentials file through the credential chain of the AWS SDK, while s3fs only reads its
+// passwd_file on startup
+func UpdateCredentials(meta *s3.FSMeta, cfg *s3.Config, target string) (bool, error) {
+	if Type(meta, cfg) == s3fsMounterType {
+		_, err := writeCredentials(target, cfg.AccessKeyID+":"+cfg.SecretAccessKey)
+		return false, err
+	}
+	_, err := writeCredentials(target, awsCredentials(cfg.AccessKeyID, cfg.SecretAccessKey))
+	return err == nil, err
+}
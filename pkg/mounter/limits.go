@@ -0,0 +1,88 @@
+package mounter
+
+import (
+	"strconv"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+)
+
+// Limits restrict resources and privileges of FUSE daemons
+type Limits struct {
+	// MemoryMax is the memory limit of a FUSE daemon in bytes, 0 means unlimited
+	MemoryMax int64
+	// CPUMillicores is the CPU limit of a FUSE daemon, 0 means unlimited
+	CPUMillicores int64
+	// Slice is the systemd slice of FUSE daemon units, empty means the default one
+	Slice string
+	// UID and GID are used by GeeseFS to drop root privileges after mounting
+	UID int
+	GID int
+	// NoNewPrivileges, PrivateTmp and ProtectSystem are set for systemd units.
+	// PrivateTmp and ProtectSystem run the daemon in its own mount namespace
+	NoNewPrivileges bool
+	PrivateTmp      bool
+	ProtectSystem   string
+}
+
+var (
+	// DefaultLimits apply to all FUSE daemons, memory and CPU limits may be overridden by volumes
+	DefaultLimits = Limits{
+		UID:             65534, // nobody
+		GID:             65534, // nogroup
+		NoNewPrivileges: true,
+	}
+)
+
+// limitsFor returns limits of the FUSE daemon of the volume
+func limitsFor(meta *s3.FSMeta) Limits {
+	limits := DefaultLimits
+	if meta.MemoryLimit > 0 {
+		limits.MemoryMax = meta.MemoryLimit
+	}
+	if meta.CPULimit > 0 {
+		limits.CPUMillicores = meta.CPULimit
+	}
+	return limits
+}
+
+// systemdProperties maps limits to properties of a transient systemd unit
+func (l Limits) systemdProperties() []systemd.Property {
+	var props []systemd.Property
+	if l.MemoryMax > 0 {
+		props = append(props, systemd.Property{Name: "MemoryMax", Value: dbus.MakeVariant(uint64(l.MemoryMax))})
+	}
+	if l.CPUMillicores > 0 {
+		// CPU time in microseconds per second of wall time
+		props = append(props, systemd.Property{Name: "CPUQuotaPerSecUSec", Value: dbus.MakeVariant(uint64(l.CPUMillicores) * 1000)})
+	}
+	if l.Slice != "" {
+		props = append(props, systemd.Property{Name: "Slice", Value: dbus.MakeVariant(l.Slice)})
+	}
+	if l.NoNewPrivileges {
+		props = append(props, systemd.Property{Name: "NoNewPrivileges", Value: dbus.MakeVariant(true)})
+	}
+	if l.PrivateTmp {
+		props = append(props, systemd.Property{Name: "PrivateTmp", Value: dbus.MakeVariant(true)})
+	}
+	if l.ProtectSystem != "" {
+		props = append(props, systemd.Property{Name: "ProtectSystem", Value: dbus.MakeVariant(l.ProtectSystem)})
+	}
+	return props
+}
+
+// goRuntimeEnvs returns environment variables applying limits to FUSE daemons written in Go.
+// They make the garbage collector keep the daemon under the memory limit instead of being killed
+func (l Limits) goRuntimeEnvs() []string {
+	var envs []string
+	if l.MemoryMax > 0 {
+		// leave some room for memory not managed by the Go runtime
+		envs = append(envs, "GOMEMLIMIT="+strconv.FormatInt(l.MemoryMax/10*9, 10))
+	}
+	if l.CPUMillicores > 0 {
+		envs = append(envs, "GOMAXPROCS="+strconv.FormatInt((l.CPUMillicores+999)/1000, 10))
+	}
+	return envs
+}
@@ -1,6 +1,7 @@
 package mounter
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -10,18 +11,20 @@ import (
 	"syscall"
 	"time"
 
-	systemd "github.com/coreos/go-systemd/v22/dbus"
-	"github.com/golang/glog"
 	"github.com/mitchellh/go-ps"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
 
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
 )
 
 // Mounter interface which can be implemented
 // by the different mounter types
 type Mounter interface {
-	Mount(target, volumeID string) error
+	// Mount starts the FUSE daemon of the volume in the target path. It logs with the logger of ctx
+	Mount(ctx context.Context, target, volumeID string) error
 }
 
 const (
@@ -30,17 +33,46 @@ const (
 	rcloneMounterType  = "rclone"
 	TypeKey            = "mounter"
 	BucketKey          = "bucket"
+	PrefixKey          = "prefix"
+	TempPrefixKey      = "tempPrefix"
+	SubPathKey         = "subPath"
 	OptionsKey         = "options"
+	MemoryLimitKey     = "memoryLimit"
+	CPULimitKey        = "cpuLimit"
+	CacheSizeKey       = "cacheSize"
+	CacheModeKey       = "cacheMode"
 )
 
-// New returns a new mounter depending on the mounterType parameter
-func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+var (
+	// ErrDaemonFailed is returned when the FUSE daemon exits without mounting the volume
+	ErrDaemonFailed = errors.New("FUSE daemon failed")
+	// ErrMountTimeout is returned when the FUSE daemon doesn't mount the volume in time
+	ErrMountTimeout = errors.New("timeout waiting for mount")
+	// ErrSystemdUnavailable is returned when the FUSE daemon can't be started as a systemd unit on the host
+	ErrSystemdUnavailable = errors.New("systemd is unavailable")
+	// ErrLimitsUnsupported is returned when limits of the volume can't be enforced on its FUSE daemon
+	ErrLimitsUnsupported = errors.New("resource limits are not supported")
+)
+
+// Type returns the mounter type used for the volume
+func Type(meta *s3.FSMeta, cfg *s3.Config) string {
 	mounter := meta.Mounter
 	// Fall back to mounterType in cfg
 	if len(meta.Mounter) == 0 {
 		mounter = cfg.Mounter
 	}
 	switch mounter {
+	case s3fsMounterType, rcloneMounterType:
+		return mounter
+	default:
+		// default to GeeseFS
+		return geesefsMounterType
+	}
+}
+
+// New returns a new mounter depending on the mounterType parameter
+func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
+	switch Type(meta, cfg) {
 	case geesefsMounterType:
 		return newGeeseFSMounter(meta, cfg)
 
@@ -56,80 +88,96 @@ func New(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	}
 }
 
-func fuseMount(path string, command string, args []string, envs []string) error {
+// fuseMount starts the FUSE daemon inside the plugin container. Its memory and CPU limits are applied
+// with a cgroup of its own, which its background process inherits
+func fuseMount(ctx context.Context, path string, command string, args []string, envs []string, limits Limits) (err error) {
+	ctx, span := tracing.Start(ctx, "fuseMount", attribute.String("command", command))
+	defer func() { tracing.End(span, err) }()
 	cmd := exec.Command(command, args...)
-	cmd.Stderr = os.Stderr
+	if limits.MemoryMax > 0 || limits.CPUMillicores > 0 {
+		cgroup, err := limits.directCgroup(path)
+		if err != nil {
+			return err
+		}
+		defer cgroup.Close()
+		cmd.SysProcAttr = &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(cgroup.Fd())}
+	}
+	stderr, err := captureStderr(path)
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = stderr
 	// cmd.Environ() returns envs inherited from the current process
 	cmd.Env = append(cmd.Environ(), envs...)
-	glog.V(3).Infof("Mounting fuse with command: %s and args: %s", command, args)
+	klog.FromContext(ctx).V(3).Info("Mounting FUSE directly", "command", command, "args", SanitizeArgs(args))
 
 	out, err := cmd.Output()
+	stderr.Close()
 	if err != nil {
-		return fmt.Errorf("Error fuseMount command: %s\nargs: %s\noutput: %s", command, args, out)
+		return fmt.Errorf("%w: %s: %v\nargs: %s\noutput: %s", ErrDaemonFailed, command, err, SanitizeArgs(args), out)
 	}
 
-	return waitForMount(path, 10*time.Second)
+	return waitForMount(ctx, path, 10*time.Second)
 }
 
+// Unmount unmounts the path if it's mounted and removes it, so that repeated calls succeed
 func Unmount(path string) error {
-	if err := mount.New("").Unmount(path); err != nil {
-		return err
-	}
-	return nil
+	return mount.CleanupMountPoint(path, mount.New(""), true)
 }
 
-func SystemdUnmount(volumeID string) (bool, error) {
-	conn, err := systemd.New()
-	if err != nil {
-		glog.Errorf("Failed to connect to systemd dbus service: %v", err)
-		return false, err
-	}
-	defer conn.Close()
-	unitName := "geesefs-" + systemd.PathBusEscape(volumeID) + ".service"
-	units, err := conn.ListUnitsByNames([]string{unitName})
-	glog.Errorf("Got %v", units)
-	if err != nil {
-		glog.Errorf("Failed to list systemd unit by name %v: %v", unitName, err)
-		return false, err
-	}
-	if len(units) == 0 || units[0].ActiveState == "inactive" || units[0].ActiveState == "failed" {
-		return true, nil
+// LazyUnmount detaches the mount even if it's busy or its FUSE daemon is dead
+func LazyUnmount(path string) error {
+	err := syscall.Unmount(path, syscall.MNT_DETACH)
+	if err == syscall.EINVAL || err == syscall.ENOENT {
+		// not mounted
+		return nil
 	}
+	return err
+}
 
-	resCh := make(chan string)
-	defer close(resCh)
-
-	_, err = conn.StopUnit(unitName, "replace", resCh)
+// ForceUnmount stops the FUSE daemon of a dead or hung mount and detaches the mount
+func ForceUnmount(ctx context.Context, volumeID string, path string) error {
+	logger := klog.FromContext(ctx)
+	process, err := FindFuseMountProcess(path)
 	if err != nil {
-		glog.Errorf("Failed to stop systemd unit (%s): %v", unitName, err)
-		return false, err
+		return err
 	}
-
-	res := <-resCh // wait until is stopped
-	glog.Infof("Systemd unit is stopped with result (%s): %s", unitName, res)
-
-	return true, nil
+	if process != nil {
+		logger.Info("Killing FUSE daemon", "pid", process.Pid, "path", path)
+		if err := process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			return err
+		}
+		process.Wait()
+	} else if _, err := ExternalUnmount(ctx, volumeID, path); err != nil {
+		logger.Error(err, "Failed to stop FUSE daemon", "path", path)
+	}
+	return LazyUnmount(path)
 }
 
-func FuseUnmount(path string) error {
+func FuseUnmount(ctx context.Context, path string) error {
+	logger := klog.FromContext(ctx)
+	forgetStderr(path)
 	if err := mount.New("").Unmount(path); err != nil {
 		return err
 	}
 	// as fuse quits immediately, we will try to wait until the process is done
 	process, err := FindFuseMountProcess(path)
 	if err != nil {
-		glog.Errorf("Error getting PID of fuse mount: %s", err)
+		logger.Error(err, "Failed to find FUSE daemon of the mount", "path", path)
 		return nil
 	}
 	if process == nil {
-		glog.Warningf("Unable to find PID of fuse mount %s, it must have finished already", path)
+		logger.V(4).Info("FUSE daemon of the mount is not found, it must have finished already", "path", path)
 		return nil
 	}
-	glog.Infof("Found fuse pid %v of mount %s, checking if it still runs", process.Pid, path)
-	return waitForProcess(process, 20)
+	logger.V(4).Info("Waiting for FUSE daemon to exit", "pid", process.Pid, "path", path)
+	return waitForProcess(logger, process, 20)
 }
 
-func waitForMount(path string, timeout time.Duration) error {
+// waitForMount waits until the FUSE daemon mounts the path
+func waitForMount(ctx context.Context, path string, timeout time.Duration) (err error) {
+	_, span := tracing.Start(ctx, "waitForMount", attribute.String("path", path))
+	defer func() { tracing.End(span, err) }()
 	var elapsed time.Duration
 	var interval = 10 * time.Millisecond
 	for {
@@ -143,7 +191,7 @@ func waitForMount(path string, timeout time.Duration) error {
 		time.Sleep(interval)
 		elapsed = elapsed + interval
 		if elapsed >= timeout {
-			return errors.New("Timeout waiting for mount")
+			return fmt.Errorf("%w %v after %v", ErrMountTimeout, path, timeout)
 		}
 	}
 }
@@ -156,36 +204,53 @@ func FindFuseMountProcess(path string) (*os.Process, error) {
 	for _, p := range processes {
 		cmdLine, err := getCmdLine(p.Pid())
 		if err != nil {
-			glog.Errorf("Unable to get cmdline of PID %v: %s", p.Pid(), err)
+			// the process has exited since the listing
+			klog.V(5).InfoS("Failed to get cmdline of process", "pid", p.Pid(), "err", err)
 			continue
 		}
 		if strings.Contains(cmdLine, path) {
-			glog.Infof("Found matching pid %v on path %s", p.Pid(), path)
+			klog.V(5).InfoS("Found FUSE daemon of the mount", "pid", p.Pid(), "path", path)
 			return os.FindProcess(p.Pid())
 		}
 	}
 	return nil, nil
 }
 
-func waitForProcess(p *os.Process, limit int) error {
+// CountFuseProcesses returns the number of FUSE daemons of all mounters visible to the plugin:
+// ones running in its container and, if it shares the PID namespace of the host, on the host
+func CountFuseProcesses() (int, error) {
+	processes, err := ps.Processes()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, p := range processes {
+		if containsString(systemdUnitPrefixes, p.Executable()) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func waitForProcess(logger klog.Logger, p *os.Process, limit int) error {
 	for backoff := 0; backoff < limit; backoff++ {
 		cmdLine, err := getCmdLine(p.Pid)
 		if err != nil {
-			glog.Warningf("Error checking cmdline of PID %v, assuming it is dead: %s", p.Pid, err)
+			logger.V(4).Info("Failed to get cmdline of FUSE daemon, assuming it has exited", "pid", p.Pid, "err", err)
 			p.Wait()
 			return nil
 		}
 		if cmdLine == "" {
-			glog.Warning("Fuse process seems dead, returning")
+			logger.V(4).Info("FUSE daemon has exited", "pid", p.Pid)
 			p.Wait()
 			return nil
 		}
 		if err := p.Signal(syscall.Signal(0)); err != nil {
-			glog.Warningf("Fuse process does not seem active or we are unprivileged: %s", err)
+			logger.V(4).Info("FUSE daemon does not seem active or we are unprivileged", "pid", p.Pid, "err", err)
 			p.Wait()
 			return nil
 		}
-		glog.Infof("Fuse process with PID %v still active, waiting...", p.Pid)
+		logger.V(4).Info("FUSE daemon is still active, waiting", "pid", p.Pid)
 		time.Sleep(time.Duration(math.Pow(1.5, float64(backoff))*100) * time.Millisecond)
 	}
 	p.Release()
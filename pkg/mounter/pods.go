@@ -0,0 +1,258 @@
+package mounter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	mounterPodPrefix       = "csi-s3-mounter-"
+	mounterPodLabel        = "app"
+	mounterPodLabelValue   = "csi-s3-mounter"
+	mounterPodVolumeIDKey  = "ru.yandex.s3.csi/volume-id"
+	mounterPodTargetKey    = "ru.yandex.s3.csi/target"
+	mounterPodMountTimeout = 2 * time.Minute
+	mounterPodStopTimeout  = 30 * time.Second
+)
+
+// PodConfig describes dedicated pods running FUSE daemons on the node of the driver
+type PodConfig struct {
+	Client    kubernetes.Interface
+	Namespace string
+	// Image must contain the FUSE daemon binaries at the same paths as the driver image
+	Image    string
+	NodeName string
+}
+
+// Pods enables running FUSE daemons in mounter pods instead of systemd units when not nil
+var Pods *PodConfig
+
+// externalMount starts the FUSE daemon outside of the plugin container, in a mounter pod if they
+// are enabled or using systemd otherwise. It returns false if the caller should mount directly
+func externalMount(ctx context.Context, target, volumeID string, unit *systemdUnit) (bool, error) {
+	if Pods != nil {
+		return true, Pods.mount(ctx, target, volumeID, unit)
+	}
+	return systemdMount(ctx, target, volumeID, unit)
+}
+
+// ExternalUnmount stops the FUSE daemon mounting the path outside of the plugin container.
+// It returns false if there is neither a mounter pod nor systemd to stop it
+func ExternalUnmount(ctx context.Context, volumeID, path string) (bool, error) {
+	if Pods != nil {
+		return true, Pods.unmount(ctx, path)
+	}
+	return SystemdUnmount(ctx, volumeID, path)
+}
+
+// mounterPodName returns the name of the pod mounting a volume at the path
+func mounterPodName(path string) string {
+	return mounterPodPrefix + mountPathHash(path)
+}
+
+// mount starts the FUSE daemon in a pod on the node and waits until the mount propagates to the host
+func (p *PodConfig) mount(ctx context.Context, target, volumeID string, unit *systemdUnit) error {
+	// The pod is removed on failures even if the request is cancelled
+	ctx = context.WithoutCancel(ctx)
+	logger := klog.FromContext(ctx)
+	name := mounterPodName(target)
+	pod, err := p.Client.CoreV1().Pods(p.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		if pod.Annotations[mounterPodTargetKey] != target {
+			return fmt.Errorf("mounter pod %s already exists, but mounts %v", name, pod.Annotations[mounterPodTargetKey])
+		}
+		if pod.DeletionTimestamp == nil && pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+			// Already mounted at right location, wait for mount
+			return p.waitForMount(ctx, target, name)
+		}
+		// The daemon has exited, replace the pod
+		if err := p.unmount(ctx, target); err != nil {
+			return err
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("Error getting mounter pod %s: %v", name, err)
+	}
+	logger.Info("Starting FUSE daemon in a mounter pod", "daemon", unit.Name, "pod", klog.KRef(p.Namespace, name),
+		"args", SanitizeArgs(unit.Args))
+	createCtx, span := tracing.Start(ctx, "mounterPod.create", attribute.String("pod", name))
+	_, err = p.Client.CoreV1().Pods(p.Namespace).Create(createCtx, p.podSpec(name, target, volumeID, unit), metav1.CreateOptions{})
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("Error creating mounter pod %s: %v", name, err)
+	}
+	return p.waitForMount(ctx, target, name)
+}
+
+// waitForMount waits for the mount of the pod and removes the pod if it doesn't appear
+func (p *PodConfig) waitForMount(ctx context.Context, target, name string) error {
+	err := waitForMount(ctx, target, mounterPodMountTimeout)
+	if err == nil {
+		return nil
+	}
+	msg := ""
+	pod, getErr := p.Client.CoreV1().Pods(p.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if getErr == nil {
+		msg = ": " + podStatusMessage(pod)
+	}
+	// keep the output of the daemon before the pod is deleted
+	tailLines := int64(stderrTailLines)
+	logs, logsErr := p.Client.CoreV1().Pods(p.Namespace).GetLogs(name, &v1.PodLogOptions{TailLines: &tailLines}).DoRaw(ctx)
+	if err := p.unmount(ctx, target); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to remove mounter pod", "pod", klog.KRef(p.Namespace, name))
+	}
+	if logsErr == nil {
+		setStderrTail(target, string(logs))
+	}
+	return fmt.Errorf("mounter pod %s/%s: %w%s", p.Namespace, name, err, msg)
+}
+
+// unmount deletes the mounter pod of the path, waits until it's gone and detaches the mount
+func (p *PodConfig) unmount(ctx context.Context, path string) (err error) {
+	forgetStderr(path)
+	name := mounterPodName(path)
+	ctx, span := tracing.Start(context.WithoutCancel(ctx), "mounterPod.delete", attribute.String("pod", name))
+	defer func() { tracing.End(span, err) }()
+	logger := klog.FromContext(ctx).WithValues("pod", klog.KRef(p.Namespace, name))
+	pods := p.Client.CoreV1().Pods(p.Namespace)
+	err = pods.Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("Error deleting mounter pod %s: %v", name, err)
+	}
+	if err == nil {
+		var elapsed time.Duration
+		interval := time.Second
+		for {
+			_, err = pods.Get(ctx, name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				break
+			}
+			if elapsed >= mounterPodStopTimeout {
+				logger.Info("Mounter pod is still terminating, detaching its mount")
+				break
+			}
+			time.Sleep(interval)
+			elapsed += interval
+		}
+		logger.V(2).Info("Mounter pod is deleted")
+	}
+	// Like ExecStopPost of systemd units, cleanup possibly dead mountpoints
+	return LazyUnmount(path)
+}
+
+// podSpec returns the pod running the FUSE daemon on the node. Targets are mounted with bidirectional
+// propagation and the plugin directory is mounted at its host path, so arguments prepared for systemd
+// units are valid in the pod
+func (p *PodConfig) podSpec(name, target, volumeID string, unit *systemdUnit) *v1.Pod {
+	privileged := true
+	automountToken := false
+	gracePeriod := int64(10)
+	bidirectional := v1.MountPropagationBidirectional
+	directory := v1.HostPathDirectory
+	charDevice := v1.HostPathCharDev
+	hostPaths := []string{hostPluginDir()}
+	if cacheRoot := hostPath(DefaultCache.Root); !strings.HasPrefix(cacheRoot+"/", hostPluginDir()+"/") {
+		hostPaths = append(hostPaths, cacheRoot)
+	}
+	volumes := []v1.Volume{
+		{
+			Name:         "target",
+			VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: target, Type: &directory}},
+		},
+		{
+			Name:         "fuse-device",
+			VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/dev/fuse", Type: &charDevice}},
+		},
+	}
+	mounts := []v1.VolumeMount{
+		{Name: "target", MountPath: target, MountPropagation: &bidirectional},
+		{Name: "fuse-device", MountPath: "/dev/fuse"},
+	}
+	for i, path := range hostPaths {
+		volumeName := fmt.Sprintf("host-dir-%d", i)
+		volumes = append(volumes, v1.Volume{
+			Name:         volumeName,
+			VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{Path: path, Type: &directory}},
+		})
+		mounts = append(mounts, v1.VolumeMount{Name: volumeName, MountPath: path})
+	}
+	var envs []v1.EnvVar
+	for _, env := range unit.Envs {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 2 {
+			envs = append(envs, v1.EnvVar{Name: kv[0], Value: kv[1]})
+		}
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: p.Namespace,
+			Labels:    map[string]string{mounterPodLabel: mounterPodLabelValue},
+			Annotations: map[string]string{
+				mounterPodVolumeIDKey: volumeID,
+				mounterPodTargetKey:   target,
+			},
+		},
+		Spec: v1.PodSpec{
+			NodeName: p.NodeName,
+			// Like transient systemd units, failed daemons are not restarted, the mount monitor remounts them
+			RestartPolicy:                 v1.RestartPolicyNever,
+			AutomountServiceAccountToken:  &automountToken,
+			TerminationGracePeriodSeconds: &gracePeriod,
+			Tolerations:                   []v1.Toleration{{Operator: v1.TolerationOpExists}},
+			Containers: []v1.Container{{
+				Name:            unit.Name,
+				Image:           p.Image,
+				ImagePullPolicy: v1.PullIfNotPresent,
+				Command:         append([]string{unit.Binary}, unit.Args...),
+				Env:             envs,
+				Resources:       unit.Limits.podResources(),
+				SecurityContext: &v1.SecurityContext{Privileged: &privileged},
+				VolumeMounts:    mounts,
+			}},
+			Volumes: volumes,
+		},
+	}
+}
+
+// podResources returns resource limits of the mounter pod container
+func (l Limits) podResources() v1.ResourceRequirements {
+	limits := v1.ResourceList{}
+	if l.MemoryMax > 0 {
+		limits[v1.ResourceMemory] = *resource.NewQuantity(l.MemoryMax, resource.BinarySI)
+	}
+	if l.CPUMillicores > 0 {
+		limits[v1.ResourceCPU] = *resource.NewMilliQuantity(l.CPUMillicores, resource.DecimalSI)
+	}
+	if len(limits) == 0 {
+		return v1.ResourceRequirements{}
+	}
+	return v1.ResourceRequirements{Limits: limits}
+}
+
+// podStatusMessage describes why the mounter pod isn't running
+func podStatusMessage(pod *v1.Pod) string {
+	msg := string(pod.Status.Phase)
+	if pod.Status.Message != "" {
+		msg += ", " + pod.Status.Message
+	}
+	for _, st := range pod.Status.ContainerStatuses {
+		if st.State.Waiting != nil {
+			msg += fmt.Sprintf(", container %s is waiting: %s %s", st.Name, st.State.Waiting.Reason, st.State.Waiting.Message)
+		}
+		if st.State.Terminated != nil {
+			msg += fmt.Sprintf(", container %s exited with code %d: %s", st.Name, st.State.Terminated.ExitCode, st.State.Terminated.Reason)
+		}
+	}
+	return msg
+}
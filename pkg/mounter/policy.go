@@ -0,0 +1,114 @@
+package mounter
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// OptionPolicy restricts mount options which may be set in volume parameters for a mounter.
+// Options are named without leading dashes, and FUSE options given with -o by their key,
+// for example "cache" for --cache=/path and "passwd_file" for -o passwd_file=/path
+type OptionPolicy struct {
+	// Allow lists the only allowed options, all options are allowed if it's empty
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists forbidden options
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Policy maps mounter types to their option policies
+type Policy map[string]OptionPolicy
+
+var (
+	// DefaultPolicy forbids options which access files of the node, load code into the daemon,
+	// change its privileges or open listeners on the node
+	DefaultPolicy = Policy{
+		geesefsMounterType: {
+			Deny: []string{"log-file", "shared-config", "cache", "profile", "setuid", "setgid"},
+		},
+		s3fsMounterType: {
+			Deny: []string{"passwd_file", "use_cache", "logfile", "ahbe_conf", "load_sse_c", "ssl_client_cert",
+				"credlib", "credlib_opts"},
+		},
+		rcloneMounterType: {
+			Deny: []string{"config", "cache-dir", "log-file", "password-command", "ca-cert", "client-cert", "client-key", "s3-shared-credentials-file",
+				"rc", "rc-addr", "rc-no-auth", "rc-serve", "rc-files", "rc-htpasswd", "rc-user", "rc-pass", "rc-web-gui",
+				"files-from", "files-from-raw", "exclude-from", "include-from", "filter-from", "temp-dir"},
+		},
+	}
+)
+
+// LoadPolicy reads option policies from a YAML file. Mounters missing in the file keep their default policies
+func LoadPolicy(path string) (Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded Policy
+	if err := yaml.UnmarshalStrict(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	policy := make(Policy)
+	for mounterType, p := range DefaultPolicy {
+		policy[mounterType] = p
+	}
+	for mounterType, p := range loaded {
+		switch mounterType {
+		case geesefsMounterType, s3fsMounterType, rcloneMounterType:
+			policy[mounterType] = p
+		default:
+			return nil, fmt.Errorf("unknown mounter %q in %s", mounterType, path)
+		}
+	}
+	return policy, nil
+}
+
+// CheckOptions returns an error if any of the options is forbidden by the policy of the mounter
+func (p Policy) CheckOptions(mounterType string, options []string) error {
+	policy := p[mounterType]
+	for _, name := range optionNames(options) {
+		if name == strings.TrimLeft(noSystemdOption, "-") {
+			continue
+		}
+		if len(policy.Allow) > 0 && !containsString(policy.Allow, name) {
+			return fmt.Errorf("mount option %q is not allowed for %s", name, mounterType)
+		}
+		if containsString(policy.Deny, name) {
+			return fmt.Errorf("mount option %q is forbidden for %s", name, mounterType)
+		}
+	}
+	return nil
+}
+
+// optionNames returns names of all options in the list. Arguments not starting
+// with a dash are values of preceding options, except for values of -o
+func optionNames(options []string) []string {
+	var names []string
+	for i := 0; i < len(options); i++ {
+		opt := options[i]
+		if !strings.HasPrefix(opt, "-") {
+			continue
+		}
+		if strings.HasPrefix(opt, "-o") && !strings.HasPrefix(opt, "--") {
+			// FUSE options: -o a=b,c or -oa=b,c
+			fuseOpts := opt[2:]
+			if fuseOpts == "" && i+1 < len(options) {
+				i++
+				fuseOpts = options[i]
+			}
+			for _, fuseOpt := range strings.Split(fuseOpts, ",") {
+				if name, _, _ := strings.Cut(fuseOpt, "="); name != "" {
+					names = append(names, name)
+				}
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(opt, "-"), "=")
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
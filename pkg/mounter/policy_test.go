@@ -0,0 +1,97 @@
+package mounter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOptionNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		want    []string
+	}{
+		{"separate FUSE options", []string{"-o", "a=b,c"}, []string{"a", "c"}},
+		{"joined FUSE options", []string{"-oa=b"}, []string{"a"}},
+		{"long option with value", []string{"--x=y"}, []string{"x"}},
+		{"long option with separate value", []string{"--x", "y"}, []string{"x"}},
+		{"short option", []string{"-f"}, []string{"f"}},
+		{"mixed", []string{"--memory-limit", "100", "-o", "ro,uid=1000", "--no-systemd"}, []string{"memory-limit", "ro", "uid", "no-systemd"}},
+		{"empty FUSE options", []string{"-o", ",,"}, nil},
+		{"trailing -o", []string{"-o"}, nil},
+		{"no options", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := optionNames(tt.options); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("optionNames(%q) = %q, want %q", tt.options, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckOptions(t *testing.T) {
+	policy := Policy{
+		geesefsMounterType: {
+			Deny: []string{"cache"},
+		},
+		s3fsMounterType: {
+			Allow: []string{"ro", "uid", "passwd_file"},
+			Deny:  []string{"passwd_file"},
+		},
+	}
+	tests := []struct {
+		name        string
+		mounterType string
+		options     []string
+		wantErr     bool
+	}{
+		{"no options", geesefsMounterType, nil, false},
+		{"allowed long option", geesefsMounterType, []string{"--memory-limit", "100"}, false},
+		{"denied long option", geesefsMounterType, []string{"--cache=/var"}, true},
+		{"denied long option with separate value", geesefsMounterType, []string{"--cache", "/var"}, true},
+		{"denied option as a value", geesefsMounterType, []string{"--dir-mode", "cache"}, false},
+		{"allowed FUSE options", s3fsMounterType, []string{"-o", "ro,uid=1000"}, false},
+		{"option missing in allow list", s3fsMounterType, []string{"-o", "ro,gid=1000"}, true},
+		{"deny takes precedence over allow", s3fsMounterType, []string{"-opasswd_file=/etc/passwd"}, true},
+		{"no-systemd is exempt from allow list", s3fsMounterType, []string{"--no-systemd", "-o", "ro"}, false},
+		{"mounter without policy", rcloneMounterType, []string{"--config=/etc/rclone.conf"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.CheckOptions(tt.mounterType, tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckOptions(%s, %q) error = %v, want error %v", tt.mounterType, tt.options, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultPolicyDeniesDangerousOptions(t *testing.T) {
+	tests := []struct {
+		mounterType string
+		options     []string
+	}{
+		{geesefsMounterType, []string{"--shared-config", "/etc/shadow"}},
+		{geesefsMounterType, []string{"--profile", "default"}},
+		{geesefsMounterType, []string{"--setuid", "0"}},
+		{geesefsMounterType, []string{"--setgid=0"}},
+		{s3fsMounterType, []string{"-o", "allow_other,passwd_file=/etc/shadow"}},
+		{s3fsMounterType, []string{"-o", "credlib=/tmp/evil.so"}},
+		{s3fsMounterType, []string{"-ocredlib_opts=x"}},
+		{rcloneMounterType, []string{"--cache-dir=/"}},
+		{rcloneMounterType, []string{"--rc"}},
+		{rcloneMounterType, []string{"--rc-addr", ":5572"}},
+		{rcloneMounterType, []string{"--rc-no-auth"}},
+		{rcloneMounterType, []string{"--files-from=/etc/shadow"}},
+		{rcloneMounterType, []string{"--exclude-from", "/etc/shadow"}},
+		{rcloneMounterType, []string{"--include-from", "/etc/shadow"}},
+		{rcloneMounterType, []string{"--filter-from", "/etc/shadow"}},
+		{rcloneMounterType, []string{"--temp-dir=/etc"}},
+	}
+	for _, tt := range tests {
+		if err := DefaultPolicy.CheckOptions(tt.mounterType, tt.options); err == nil {
+			t.Errorf("DefaultPolicy.CheckOptions(%s, %q) succeeded", tt.mounterType, tt.options)
+		}
+	}
+}
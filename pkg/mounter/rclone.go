@@ -1,6 +1,7 @@
 package mounter
 
 import (
+	"context"
 	"fmt"
 	"path"
 
@@ -30,25 +31,73 @@ func newRcloneMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	}, nil
 }
 
-func (rclone *rcloneMounter) Mount(target, volumeID string) error {
+func (rclone *rcloneMounter) Mount(ctx context.Context, target, volumeID string) error {
+	withSystemd, mountOptions := useSystemd(rclone.meta.MountOptions)
+	limits := limitsFor(rclone.meta)
 	args := []string{
 		"mount",
 		fmt.Sprintf(":s3:%s", path.Join(rclone.meta.BucketName, rclone.meta.Prefix)),
 		target,
-		"--daemon",
 		"--s3-provider=AWS",
 		"--s3-env-auth=true",
 		fmt.Sprintf("--s3-endpoint=%s", rclone.url),
 		"--allow-other",
-		"--vfs-cache-mode=writes",
 	}
 	if rclone.region != "" {
 		args = append(args, fmt.Sprintf("--s3-region=%s", rclone.region))
 	}
-	args = append(args, rclone.meta.MountOptions...)
-	envs := []string{
-		"AWS_ACCESS_KEY_ID=" + rclone.accessKeyID,
-		"AWS_SECRET_ACCESS_KEY=" + rclone.secretAccessKey,
+	if rclone.meta.ReadOnly {
+		args = append(args, "--read-only")
 	}
-	return fuseMount(target, rcloneCmd, args, envs)
+	if rclone.meta.MountGroup != "" {
+		args = append(args, fmt.Sprintf("--gid=%s", rclone.meta.MountGroup))
+	}
+	// --s3-env-auth reads the shared credentials file
+	credentials, err := writeCredentials(target, awsCredentials(rclone.accessKeyID, rclone.secretAccessKey))
+	if err != nil {
+		return err
+	}
+	cache, err := prepareVolumeCache(target, rclone.meta, rcloneMounterType)
+	if err != nil {
+		return err
+	}
+	if withSystemd {
+		// rclone stays in the foreground without --daemon
+		started, err := externalMount(ctx, target, volumeID, &systemdUnit{
+			Name:        rcloneCmd,
+			Description: "rclone mount",
+			Binary:      "/usr/bin/rclone",
+			// rclone mounts with fusermount, which may be missing on the host
+			Helpers: []string{"/usr/bin/fusermount3", "/usr/bin/fusermount"},
+			Args:    append(append(args, rclone.cacheArgs(cache, true)...), mountOptions...),
+			Envs:    append(limits.goRuntimeEnvs(), "AWS_SHARED_CREDENTIALS_FILE="+credentials.HostPath),
+			Limits:  limits,
+		})
+		if started {
+			return err
+		}
+	}
+	envs := append(limits.goRuntimeEnvs(), "AWS_SHARED_CREDENTIALS_FILE="+credentials.ContainerPath)
+	args = append(append(args, rclone.cacheArgs(cache, false)...), mountOptions...)
+	return fuseMount(ctx, target, rcloneCmd, append(args, "--daemon"), envs, limits)
+}
+
+func (rclone *rcloneMounter) cacheArgs(cache *cacheDir, onHost bool) []string {
+	if cache == nil {
+		return []string{"--vfs-cache-mode=" + CacheModeOff}
+	}
+	mode := rclone.meta.CacheMode
+	if mode == "" {
+		mode = CacheModeWrites
+	}
+	args := []string{"--vfs-cache-mode=" + mode}
+	if onHost {
+		args = append(args, "--cache-dir="+cache.HostPath)
+	} else {
+		args = append(args, "--cache-dir="+cache.ContainerPath)
+	}
+	if cache.Size > 0 {
+		args = append(args, fmt.Sprintf("--vfs-cache-max-size=%d", cache.Size))
+	}
+	return args
 }
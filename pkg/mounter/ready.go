@@ -0,0 +1,45 @@
+package mounter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+)
+
+// fuseDevice must be mounted into the plugin container to start FUSE daemons
+const fuseDevice = "/dev/fuse"
+
+// CheckReady returns the reasons why FUSE daemons can't be started on the node, or nil if they can.
+// Daemons of mounter pods come from the mounter image, so neither their binaries in the plugin
+// container nor systemd are required then. The plugin container only runs them for volumes with
+// --no-systemd, which fail to mount on their own if the daemon is missing
+func CheckReady(ctx context.Context) []string {
+	var reasons []string
+	if Pods == nil {
+		for _, cmd := range []string{geesefsCmd, s3fsCmd, rcloneCmd} {
+			if _, err := exec.LookPath(cmd); err != nil {
+				reasons = append(reasons, fmt.Sprintf("FUSE daemon %s is not installed: %v", cmd, err))
+			}
+		}
+	}
+	if info, err := os.Stat(fuseDevice); err != nil {
+		reasons = append(reasons, fmt.Sprintf("%s is not available: %v", fuseDevice, err))
+	} else if info.Mode()&os.ModeCharDevice == 0 {
+		reasons = append(reasons, fmt.Sprintf("%s is not a character device", fuseDevice))
+	}
+	if Pods == nil {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		conn, err := systemd.NewWithContext(ctx)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("systemd D-Bus is unreachable: %v", err))
+		} else {
+			conn.Close()
+		}
+	}
+	return reasons
+}
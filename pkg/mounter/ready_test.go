@@ -0,0 +1,42 @@
+package mounter
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCheckReadyMounters(t *testing.T) {
+	tests := []struct {
+		name        string
+		pods        *PodConfig
+		wantMissing []string
+	}{
+		{"systemd", nil, []string{geesefsCmd, s3fsCmd, rcloneCmd}},
+		{"mounter pods", &PodConfig{Image: "csi-s3"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// no FUSE daemon is installed in the plugin container
+			t.Setenv("PATH", t.TempDir())
+			oldPods := Pods
+			Pods = tt.pods
+			t.Cleanup(func() { Pods = oldPods })
+
+			var missing []string
+			for _, reason := range CheckReady(context.Background()) {
+				for _, cmd := range []string{geesefsCmd, s3fsCmd, rcloneCmd} {
+					if strings.HasPrefix(reason, "FUSE daemon "+cmd+" ") {
+						missing = append(missing, cmd)
+					}
+				}
+				if tt.pods != nil && strings.Contains(reason, "systemd") {
+					t.Errorf("CheckReady() with mounter pods requires systemd: %s", reason)
+				}
+			}
+			if strings.Join(missing, ",") != strings.Join(tt.wantMissing, ",") {
+				t.Errorf("CheckReady() reports missing daemons %q, want %q", missing, tt.wantMissing)
+			}
+		})
+	}
+}
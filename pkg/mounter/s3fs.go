@@ -1,18 +1,19 @@
 package mounter
 
 import (
+	"context"
 	"fmt"
-	"os"
 
 	"github.com/yandex-cloud/k8s-csi-s3/pkg/s3"
 )
 
 // Implements Mounter
 type s3fsMounter struct {
-	meta          *s3.FSMeta
-	url           string
-	region        string
-	pwFileContent string
+	meta            *s3.FSMeta
+	url             string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
 }
 
 const (
@@ -21,17 +22,17 @@ const (
 
 func newS3fsMounter(meta *s3.FSMeta, cfg *s3.Config) (Mounter, error) {
 	return &s3fsMounter{
-		meta:          meta,
-		url:           cfg.Endpoint,
-		region:        cfg.Region,
-		pwFileContent: cfg.AccessKeyID + ":" + cfg.SecretAccessKey,
+		meta:            meta,
+		url:             cfg.Endpoint,
+		region:          cfg.Region,
+		accessKeyID:     cfg.AccessKeyID,
+		secretAccessKey: cfg.SecretAccessKey,
 	}, nil
 }
 
-func (s3fs *s3fsMounter) Mount(target, volumeID string) error {
-	if err := writes3fsPass(s3fs.pwFileContent); err != nil {
-		return err
-	}
+func (s3fs *s3fsMounter) Mount(ctx context.Context, target, volumeID string) error {
+	withSystemd, mountOptions := useSystemd(s3fs.meta.MountOptions)
+	limits := limitsFor(s3fs.meta)
 	args := []string{
 		fmt.Sprintf("%s:/%s", s3fs.meta.BucketName, s3fs.meta.Prefix),
 		target,
@@ -43,20 +44,47 @@ func (s3fs *s3fsMounter) Mount(target, volumeID string) error {
 	if s3fs.region != "" {
 		args = append(args, "-o", fmt.Sprintf("endpoint=%s", s3fs.region))
 	}
-	args = append(args, s3fs.meta.MountOptions...)
-	return fuseMount(target, s3fsCmd, args, nil)
-}
-
-func writes3fsPass(pwFileContent string) error {
-	pwFileName := fmt.Sprintf("%s/.passwd-s3fs", os.Getenv("HOME"))
-	pwFile, err := os.OpenFile(pwFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if s3fs.meta.ReadOnly {
+		args = append(args, "-o", "ro")
+	}
+	if s3fs.meta.MountGroup != "" {
+		args = append(args, "-o", fmt.Sprintf("gid=%s", s3fs.meta.MountGroup))
+	}
+	args = append(args, mountOptions...)
+	credentials, err := writeCredentials(target, s3fs.accessKeyID+":"+s3fs.secretAccessKey)
 	if err != nil {
 		return err
 	}
-	_, err = pwFile.WriteString(pwFileContent)
+	cache, err := prepareVolumeCache(target, s3fs.meta, s3fsMounterType)
 	if err != nil {
 		return err
 	}
-	pwFile.Close()
-	return nil
+	if cache != nil {
+		// del_cache cleans up the cache left by a previous daemon of the mount
+		args = append(args, "-o", "del_cache")
+	}
+	if withSystemd {
+		started, err := externalMount(ctx, target, volumeID, &systemdUnit{
+			Name:        s3fsCmd,
+			Description: "s3fs mount",
+			Binary:      "/usr/bin/s3fs",
+			Args:        append(append(args, "-f", "-o", "passwd_file="+credentials.HostPath), s3fsCacheArgs(cache, true)...),
+			Limits:      limits,
+		})
+		if started {
+			return err
+		}
+	}
+	args = append(append(args, "-o", "passwd_file="+credentials.ContainerPath), s3fsCacheArgs(cache, false)...)
+	return fuseMount(ctx, target, s3fsCmd, args, nil, limits)
+}
+
+func s3fsCacheArgs(cache *cacheDir, onHost bool) []string {
+	if cache == nil {
+		return nil
+	}
+	if onHost {
+		return []string{"-o", "use_cache=" + cache.HostPath}
+	}
+	return []string{"-o", "use_cache=" + cache.ContainerPath}
 }
@@ -0,0 +1,67 @@
+package mounter
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces values of credential-looking mount options in logs and errors
+const Redacted = "***stripped***"
+
+// Mount options with matching names are considered to hold credentials
+var secretOptionName = regexp.MustCompile(`(?i)(secret|passw|token|credential|access.?key|auth|sse.?c.?key)`)
+
+// IsSecretOption returns true if the option or secret key name looks like it holds credentials
+func IsSecretOption(name string) bool {
+	return secretOptionName.MatchString(name)
+}
+
+// SanitizeArgs returns a copy of FUSE daemon arguments with values of credential-looking options
+// redacted. It understands --name=value, --name value and -o name=value,name=value forms
+func SanitizeArgs(args []string) []string {
+	sanitized := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-o" && i+1 < len(args) {
+			sanitized = append(sanitized, arg, sanitizeOptionList(args[i+1]))
+			i++
+			continue
+		}
+		if strings.HasPrefix(arg, "-o") && len(arg) > 2 && !strings.HasPrefix(arg, "--") {
+			sanitized = append(sanitized, "-o"+sanitizeOptionList(arg[2:]))
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			sanitized = append(sanitized, arg)
+			continue
+		}
+		name, _, hasValue := strings.Cut(arg, "=")
+		if !secretOptionName.MatchString(name) {
+			sanitized = append(sanitized, arg)
+		} else if hasValue {
+			sanitized = append(sanitized, name+"="+Redacted)
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			sanitized = append(sanitized, arg, Redacted)
+			i++
+		} else {
+			sanitized = append(sanitized, arg)
+		}
+	}
+	return sanitized
+}
+
+// SanitizeOptions redacts credential-looking options in the options volume attribute
+func SanitizeOptions(options string) string {
+	return strings.Join(SanitizeArgs(strings.Fields(options)), " ")
+}
+
+// sanitizeOptionList redacts values in a comma-separated list of name=value options
+func sanitizeOptionList(list string) string {
+	opts := strings.Split(list, ",")
+	for i, opt := range opts {
+		if name, _, hasValue := strings.Cut(opt, "="); hasValue && secretOptionName.MatchString(name) {
+			opts[i] = name + "=" + Redacted
+		}
+	}
+	return strings.Join(opts, ",")
+}
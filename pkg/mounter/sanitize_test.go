@@ -0,0 +1,30 @@
+package mounter
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestFuseMountErrorRedactsCredentials(t *testing.T) {
+	secret := "OPTIONREDACTIONTEST"
+	args := []string{
+		"--s3-secret-access-key=" + secret,
+		"--s3-session-token", secret,
+		"-o", "allow_other,passwd=" + secret,
+		"-opassword=" + secret,
+		"bucket:prefix", "/mnt/target",
+	}
+	err := fuseMount(context.Background(), "/mnt/target", "false", args, nil, Limits{})
+	if err == nil {
+		t.Fatal("fuseMount of a failing command succeeded")
+	}
+	if strings.Contains(err.Error(), secret) {
+		t.Errorf("fuseMount error contains a credential: %v", err)
+	}
+	for _, keep := range []string{"allow_other", "bucket:prefix", "/mnt/target"} {
+		if !strings.Contains(err.Error(), keep) {
+			t.Errorf("fuseMount error lacks %q: %v", keep, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package mounter
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+)
+
+// Linux reports CPU times in /proc in clock ticks, which are 1/100 s on all supported architectures
+const clockTicks = 100
+
+// DaemonStats is resource usage of the FUSE daemon of a mount
+type DaemonStats struct {
+	// CPUSeconds is the total CPU time used by the daemon since it has started
+	CPUSeconds float64
+	RSSBytes   int64
+	// Restarts of the daemon by systemd
+	Restarts int64
+}
+
+// GetDaemonStats returns resource usage of the FUSE daemon mounting the path, either running directly
+// or under systemd. It returns nil if the daemon is not found, including daemons in mounter pods
+func GetDaemonStats(path string) (*DaemonStats, error) {
+	process, err := FindFuseMountProcess(path)
+	if err != nil {
+		return nil, err
+	}
+	if process != nil {
+		return procStats(process.Pid)
+	}
+	if Pods != nil {
+		return nil, nil
+	}
+	return systemdStats(path)
+}
+
+// procStats reads resource usage of a process visible to the plugin from /proc
+func procStats(pid int) (*DaemonStats, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	// the command in parentheses may contain spaces, fields are counted after it
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	// utime and stime are fields 14 and 15, the state (field 3) is the first one after the command
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	// rss is field 24, in pages
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	return &DaemonStats{
+		CPUSeconds: float64(utime+stime) / clockTicks,
+		RSSBytes:   rss * int64(os.Getpagesize()),
+	}, nil
+}
+
+// systemdStats reads resource usage of the systemd unit mounting the path from its properties
+func systemdStats(path string) (*DaemonStats, error) {
+	conn, err := systemd.New()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for _, prefix := range systemdUnitPrefixes {
+		unitName := systemdUnitName(prefix, path)
+		props, err := conn.GetUnitTypeProperties(unitName, "Service")
+		if err != nil {
+			return nil, err
+		}
+		if pid, _ := props["MainPID"].(uint32); pid == 0 {
+			continue
+		}
+		stats := &DaemonStats{}
+		// systemd reports unknown values as the maximum integer
+		if cpu, ok := props["CPUUsageNSec"].(uint64); ok && cpu != math.MaxUint64 {
+			stats.CPUSeconds = float64(cpu) / 1e9
+		}
+		if mem, ok := props["MemoryCurrent"].(uint64); ok && mem != math.MaxUint64 {
+			stats.RSSBytes = int64(mem)
+		}
+		if restarts, ok := props["NRestarts"].(uint32); ok {
+			stats.Restarts = int64(restarts)
+		}
+		return stats, nil
+	}
+	return nil, nil
+}
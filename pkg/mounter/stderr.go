@@ -0,0 +1,115 @@
+package mounter
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stderrTailLines is the number of last lines of error output kept for every mount
+const stderrTailLines = 20
+
+// tailBuffer keeps the last lines written to it
+type tailBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+	// done is closed when the output is closed by all processes writing it
+	done chan struct{}
+}
+
+func newTailBuffer() *tailBuffer {
+	return &tailBuffer{done: make(chan struct{})}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.lines = append(b.lines, string(b.partial[:i]))
+		b.partial = b.partial[i+1:]
+	}
+	if len(b.lines) > stderrTailLines {
+		b.lines = b.lines[len(b.lines)-stderrTailLines:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := b.lines
+	if len(b.partial) > 0 {
+		lines = append(lines[:len(lines):len(lines)], string(b.partial))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	stderrMu    sync.Mutex
+	stderrTails = make(map[string]*tailBuffer)
+)
+
+// captureStderr returns the write end of a pipe to pass to the FUSE daemon of the path as stderr.
+// Output is forwarded to the stderr of the driver and its tail is kept until the path is unmounted.
+// The caller must close the returned file once the daemon is started
+func captureStderr(path string) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	tail := newTailBuffer()
+	stderrMu.Lock()
+	stderrTails[path] = tail
+	stderrMu.Unlock()
+	go func() {
+		// daemons keep the pipe open while they run, so this ends when they exit
+		io.Copy(io.MultiWriter(os.Stderr, tail), r)
+		r.Close()
+		close(tail.done)
+	}()
+	return w, nil
+}
+
+// setStderrTail records error output of a daemon which is not started by the driver itself
+func setStderrTail(path string, output string) {
+	tail := newTailBuffer()
+	tail.Write([]byte(output))
+	close(tail.done)
+	stderrMu.Lock()
+	stderrTails[path] = tail
+	stderrMu.Unlock()
+}
+
+// StderrTail returns the last lines of error output of the FUSE daemon of the path, empty if it's unknown.
+// It's available for daemons started in the plugin container and in mounter pods, while output of
+// systemd units goes to the journal of the node
+func StderrTail(path string) string {
+	stderrMu.Lock()
+	tail := stderrTails[path]
+	stderrMu.Unlock()
+	if tail == nil {
+		return ""
+	}
+	// a daemon failed to mount may still be flushing its output
+	select {
+	case <-tail.done:
+	case <-time.After(100 * time.Millisecond):
+	}
+	return tail.String()
+}
+
+// forgetStderr drops the output of the daemon of the path once it's unmounted
+func forgetStderr(path string) {
+	stderrMu.Lock()
+	delete(stderrTails, path)
+	stderrMu.Unlock()
+}
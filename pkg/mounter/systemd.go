@@ -0,0 +1,297 @@
+package mounter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	systemd "github.com/coreos/go-systemd/v22/dbus"
+	dbus "github.com/godbus/dbus/v5"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
+)
+
+const (
+	noSystemdOption = "--no-systemd"
+	// Plugin directory of the host is mounted into the container here
+	containerPluginDir = "/csi"
+)
+
+// Prefixes of systemd units of all mounters
+var systemdUnitPrefixes = []string{geesefsCmd, s3fsCmd, rcloneCmd}
+
+// systemdUnit describes a FUSE daemon to be started as a transient systemd unit on the host
+type systemdUnit struct {
+	// Name of the FUSE daemon, used as the prefix of the unit name
+	Name        string
+	Description string
+	// Binary is the path of the FUSE daemon in the container. It's copied to the plugin
+	// directory to be started on the host, mounter pods start it from their image
+	Binary string
+	// Helpers are binaries the daemon runs, copied to the host along with it
+	Helpers []string
+	// Args must make the daemon run in the foreground
+	Args []string
+	// Envs are visible to all users of the host, so they must not contain secrets
+	Envs   []string
+	Limits Limits
+}
+
+// hostPluginDir returns the path of the plugin directory on the host
+func hostPluginDir() string {
+	pluginDir := os.Getenv("PLUGIN_DIR")
+	if pluginDir == "" {
+		pluginDir = "/var/lib/kubelet/plugins/ru.yandex.s3.csi"
+	}
+	return pluginDir
+}
+
+// systemdUnitName returns the name of the unit mounting a volume at the path. Units are keyed
+// on the mount path and not on the volume ID, so that the same bucket may back multiple volumes
+func systemdUnitName(prefix, path string) string {
+	return prefix + "-" + mountPathHash(path) + ".service"
+}
+
+// mountPathHash returns a short hash identifying the mount path in file and unit names
+func mountPathHash(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(hash[:8])
+}
+
+// legacySystemdUnits returns active units mounting the path which were started by older versions
+// of the driver and named after the volume ID
+func legacySystemdUnits(logger klog.Logger, conn *systemd.Conn, volumeID, path string) ([]string, error) {
+	patterns := make([]string, 0, len(systemdUnitPrefixes))
+	for _, prefix := range systemdUnitPrefixes {
+		patterns = append(patterns, prefix+"-"+systemd.PathBusEscape(volumeID)+"*.service")
+	}
+	units, err := conn.ListUnitsByPatterns([]string{"active", "activating", "reloading"}, patterns)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, unit := range units {
+		prop, err := conn.GetUnitTypeProperty(unit.Name, "Service", "ExecStart")
+		if err != nil {
+			logger.Error(err, "Failed to get ExecStart of systemd unit", "unit", unit.Name)
+			continue
+		}
+		if containsString(execStartArgs(prop.Value.Value()), path) {
+			names = append(names, unit.Name)
+		}
+	}
+	return names, nil
+}
+
+// execStartArgs extracts arguments of the first command from the ExecStart property of a unit
+func execStartArgs(value interface{}) []string {
+	execs, ok := value.([][]interface{})
+	if !ok || len(execs) == 0 || len(execs[0]) < 2 {
+		return nil
+	}
+	args, _ := execs[0][1].([]string)
+	return args
+}
+
+// useSystemd removes --no-systemd from mount options and returns false if it was there
+func useSystemd(options []string) (bool, []string) {
+	filtered := make([]string, 0, len(options))
+	use := true
+	for _, opt := range options {
+		if opt == noSystemdOption {
+			use = false
+		} else {
+			filtered = append(filtered, opt)
+		}
+	}
+	return use, filtered
+}
+
+func copyBinary(from, to string) error {
+	st, err := os.Stat(from)
+	if err != nil {
+		return fmt.Errorf("Failed to stat %s: %v", from, err)
+	}
+	st2, err := os.Stat(to)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to stat %s: %v", to, err)
+	}
+	if err != nil || st2.Size() != st.Size() || st2.ModTime() != st.ModTime() {
+		if err == nil {
+			// remove the file first to not hit "text file busy" errors
+			err = os.Remove(to)
+			if err != nil {
+				return fmt.Errorf("Error removing %s to update it: %v", to, err)
+			}
+		}
+		bin, err := os.ReadFile(from)
+		if err != nil {
+			return fmt.Errorf("Error copying %s to %s: %v", from, to, err)
+		}
+		err = os.WriteFile(to, bin, 0755)
+		if err != nil {
+			return fmt.Errorf("Error copying %s to %s: %v", from, to, err)
+		}
+		err = os.Chtimes(to, st.ModTime(), st.ModTime())
+		if err != nil {
+			return fmt.Errorf("Error copying %s to %s: %v", from, to, err)
+		}
+	}
+	return nil
+}
+
+// systemdMount starts the FUSE daemon using systemd on the host, so it doesn't get killed
+// when the container exits. It returns false if systemd is not available or the daemon
+// can't run on the host, then the caller should mount the volume directly
+func systemdMount(ctx context.Context, target, volumeID string, unit *systemdUnit) (bool, error) {
+	logger := klog.FromContext(ctx).WithValues("daemon", unit.Name)
+	conn, err := systemd.New()
+	if err != nil {
+		logger.Error(err, "systemd is not available, starting FUSE daemon inside the plugin container. "+
+			"Its mount will break when the node plugin restarts, use mounter pods on such nodes")
+		return false, nil
+	}
+	defer conn.Close()
+	// systemd is present
+	command, err := hostCommand(unit.Binary, unit.Name)
+	if err != nil {
+		return true, fmt.Errorf("%w: failed to copy %s to the host: %v", ErrSystemdUnavailable, unit.Binary, err)
+	}
+	envs := unit.Envs
+	if len(unit.Helpers) > 0 {
+		binDir, err := hostHelpers(unit.Helpers)
+		if err != nil {
+			return true, fmt.Errorf("%w: %v", ErrSystemdUnavailable, err)
+		}
+		envs = append(envs[:len(envs):len(envs)], "PATH="+binDir+":/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+	}
+	args := append(command, unit.Args...)
+	unitName := systemdUnitName(unit.Name, target)
+	logger.Info("Starting FUSE daemon using systemd", "unit", unitName, "args", SanitizeArgs(args))
+	legacyUnits, err := legacySystemdUnits(logger, conn, volumeID, target)
+	if err != nil {
+		logger.Error(err, "Failed to list systemd units started by older versions of the driver")
+	}
+	for _, legacyUnit := range legacyUnits {
+		// The mount is dead if it's mounted again, replace the unit started by an older version of the driver
+		conn.StopUnit(legacyUnit, "replace", nil)
+		conn.ResetFailedUnit(legacyUnit)
+	}
+	newProps := []systemd.Property{
+		systemd.Property{
+			Name:  "Description",
+			Value: dbus.MakeVariant(unit.Description + " for Kubernetes volume " + volumeID),
+		},
+		systemd.PropExecStart(args, false),
+		systemd.Property{
+			Name:  "CollectMode",
+			Value: dbus.MakeVariant("inactive-or-failed"),
+		},
+	}
+	newProps = append(newProps, unit.Limits.systemdProperties()...)
+	if len(envs) > 0 {
+		newProps = append(newProps, systemd.Property{
+			Name:  "Environment",
+			Value: dbus.MakeVariant(envs),
+		})
+	}
+	unitProps, err := conn.GetAllProperties(unitName)
+	if err == nil {
+		// Unit already exists
+		if s, ok := unitProps["ActiveState"].(string); ok && (s == "active" || s == "activating" || s == "reloading") {
+			// Unit is already active
+			execArgs := execStartArgs(unitProps["ExecStart"])
+			if !containsString(execArgs, target) {
+				return true, fmt.Errorf(
+					"systemd unit %s is already active, but doesn't mount %v. It's started with %v",
+					unitName, target, execArgs,
+				)
+			}
+			// Already mounted at right location, wait for mount
+			return true, waitForMount(ctx, target, 30*time.Second)
+		} else {
+			// Stop and garbage collect the unit if automatic collection didn't work for some reason
+			conn.StopUnit(unitName, "replace", nil)
+			conn.ResetFailedUnit(unitName)
+		}
+	}
+	unitPath := "/run/systemd/system/" + unitName + ".d"
+	err = os.MkdirAll(unitPath, 0755)
+	if err != nil {
+		return true, fmt.Errorf("%w: error creating directory %s: %v", ErrSystemdUnavailable, unitPath, err)
+	}
+	// force & lazy unmount to cleanup possibly dead mountpoints
+	err = os.WriteFile(
+		unitPath+"/50-StopProps.conf",
+		[]byte("[Service]\nExecStopPost=/bin/umount -f -l "+target+"\nTimeoutStopSec=20\n"),
+		0600,
+	)
+	if err != nil {
+		return true, fmt.Errorf("%w: error writing %v/50-ExecStopPost.conf: %v", ErrSystemdUnavailable, unitPath, err)
+	}
+	_, span := tracing.Start(ctx, "systemd.startUnit", attribute.String("unit", unitName))
+	_, err = conn.StartTransientUnit(unitName, "replace", newProps, nil)
+	tracing.End(span, err)
+	if err != nil {
+		return true, fmt.Errorf("%w: error starting unit %s on host: %v", ErrSystemdUnavailable, unitName, err)
+	}
+	return true, waitForMount(ctx, target, 30*time.Second)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SystemdUnmount stops the systemd unit of any mounter mounting the volume at the path.
+// It returns false if systemd is not available
+func SystemdUnmount(ctx context.Context, volumeID, path string) (bool, error) {
+	logger := klog.FromContext(ctx)
+	conn, err := systemd.New()
+	if err != nil {
+		// Callers fall back to unmounting directly, so it's not an error
+		logger.V(4).Info("systemd is not available", "err", err)
+		return false, err
+	}
+	defer conn.Close()
+	unitNames := make([]string, 0, len(systemdUnitPrefixes))
+	for _, prefix := range systemdUnitPrefixes {
+		unitNames = append(unitNames, systemdUnitName(prefix, path))
+	}
+	units, err := conn.ListUnitsByNames(unitNames)
+	if err != nil {
+		return false, fmt.Errorf("failed to list systemd units %v: %v", unitNames, err)
+	}
+	var active []string
+	for _, unit := range units {
+		if unit.ActiveState != "inactive" && unit.ActiveState != "failed" {
+			active = append(active, unit.Name)
+		}
+	}
+	legacyUnits, err := legacySystemdUnits(logger, conn, volumeID, path)
+	if err != nil {
+		return false, fmt.Errorf("failed to list systemd units of volume %v: %v", volumeID, err)
+	}
+	for _, unitName := range append(active, legacyUnits...) {
+		_, span := tracing.Start(ctx, "systemd.stopUnit", attribute.String("unit", unitName))
+		resCh := make(chan string, 1)
+		_, err = conn.StopUnit(unitName, "replace", resCh)
+		if err != nil {
+			tracing.End(span, err)
+			return false, fmt.Errorf("failed to stop systemd unit %s: %v", unitName, err)
+		}
+		res := <-resCh // wait until is stopped
+		span.SetAttributes(attribute.String("result", res))
+		tracing.End(span, nil)
+		logger.Info("Stopped systemd unit of FUSE daemon", "unit", unitName, "result", res)
+	}
+	return true, nil
+}
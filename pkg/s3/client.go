@@ -10,9 +10,9 @@ import (
 	"strconv"
 	"sync/atomic"
 
-	"github.com/golang/glog"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -33,6 +33,11 @@ type Config struct {
 	Endpoint        string
 	Mounter         string
 	Insecure        bool
+	// Retry is applied to every S3 operation
+	Retry RetryPolicy
+	// RateLimit and RateBurst configure the token bucket shared by all clients of the endpoint
+	RateLimit float64
+	RateBurst int
 }
 
 type FSMeta struct {
@@ -41,6 +46,14 @@ type FSMeta struct {
 	Mounter       string   `json:"Mounter"`
 	MountOptions  []string `json:"MountOptions"`
 	CapacityBytes int64    `json:"CapacityBytes"`
+	ReadOnly      bool     `json:"ReadOnly"`
+	MountGroup    string   `json:"MountGroup"`
+	// MemoryLimit in bytes and CPULimit in millicores restrict the FUSE daemon
+	MemoryLimit int64 `json:"MemoryLimit"`
+	CPULimit    int64 `json:"CPULimit"`
+	// CacheSize in bytes and CacheMode configure the local disk cache of the FUSE daemon
+	CacheSize int64  `json:"CacheSize"`
+	CacheMode string `json:"CacheMode"`
 }
 
 func NewClient(cfg *Config) (*s3Client, error) {
@@ -57,17 +70,24 @@ func NewClient(cfg *Config) (*s3Client, error) {
 		endpoint = u.Hostname() + ":" + u.Port()
 	}
 
-	var transport = &http.Transport{}
+	var transport http.RoundTripper
+	httpTransport := &http.Transport{}
 	if client.Config.Insecure {
 		tlsConfig := &tls.Config{}
 		tlsConfig.InsecureSkipVerify = true
-		transport.TLSClientConfig = tlsConfig
+		httpTransport.TLSClientConfig = tlsConfig
+	}
+	transport = httpTransport
+	if limiter := endpointLimiter(endpoint, client.Config.RateLimit, client.Config.RateBurst); limiter != nil {
+		transport = &rateLimitedTransport{limiter: limiter, next: transport}
 	}
 	minioClient, err := minio.New(endpoint, &minio.Options{
 		Transport: transport,
 		Creds:     credentials.NewStaticV4(client.Config.AccessKeyID, client.Config.SecretAccessKey, ""),
 		Region:    client.Config.Region,
 		Secure:    ssl,
+		// Retries are handled by client.Config.Retry
+		MaxRetries: 1,
 	})
 	if err != nil {
 		return nil, err
@@ -77,48 +97,128 @@ func NewClient(cfg *Config) (*s3Client, error) {
 	return client, nil
 }
 
-func NewClientFromSecret(secret map[string]string) (*s3Client, error) {
+// NewClientFromSecret returns a client with credentials and the endpoint from the secret. Its operations
+// are traced and logged as a part of the operation in ctx, but they are not cancelled with it
+func NewClientFromSecret(ctx context.Context, secret map[string]string) (*s3Client, error) {
 	insecure, _ := strconv.ParseBool(secret["insecure"])
-	return NewClient(&Config{
+	client, err := NewClient(&Config{
 		AccessKeyID:     secret["accessKeyID"],
 		SecretAccessKey: secret["secretAccessKey"],
 		Region:          secret["region"],
 		Endpoint:        secret["endpoint"],
 		// Mounter is set in the volume preferences, not secrets
-		Mounter:  "",
-		Insecure: insecure,
+		Mounter:   "",
+		Insecure:  insecure,
+		Retry:     DefaultRetryPolicy,
+		RateLimit: DefaultRateLimit,
+		RateBurst: DefaultRateBurst,
 	})
+	if err != nil {
+		return nil, err
+	}
+	client.ctx = context.WithoutCancel(ctx)
+	return client, nil
 }
 
 func (client *s3Client) BucketExists(bucketName string) (bool, error) {
-	return client.minio.BucketExists(client.ctx, bucketName)
+	var exists bool
+	err := client.Config.Retry.do(client.ctx, "BucketExists", bucketName, func(ctx context.Context) error {
+		var err error
+		exists, err = client.minio.BucketExists(ctx, bucketName)
+		return err
+	})
+	return exists, err
 }
 
 func (client *s3Client) CreateBucket(bucketName string) error {
-	return client.minio.MakeBucket(client.ctx, bucketName, minio.MakeBucketOptions{Region: client.Config.Region})
+	return client.Config.Retry.do(client.ctx, "MakeBucket", bucketName, func(ctx context.Context) error {
+		err := client.minio.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{Region: client.Config.Region})
+		if err != nil && minio.ToErrorResponse(err).Code == "BucketAlreadyOwnedByYou" {
+			// The previous attempt succeeded, but its response was lost
+			return nil
+		}
+		return err
+	})
 }
 
 func (client *s3Client) CreatePrefix(bucketName string, prefix string) error {
 	if prefix != "" {
-		_, err := client.minio.PutObject(client.ctx, bucketName, prefix+"/", bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
-		if err != nil {
+		return client.Config.Retry.do(client.ctx, "PutObject", bucketName, func(ctx context.Context) error {
+			_, err := client.minio.PutObject(ctx, bucketName, prefix+"/", bytes.NewReader([]byte("")), 0, minio.PutObjectOptions{})
 			return err
-		}
+		})
 	}
 	return nil
 }
 
+func (client *s3Client) removeObject(bucketName, key, versionID string) error {
+	return client.Config.Retry.do(client.ctx, "RemoveObject", bucketName, func(ctx context.Context) error {
+		return client.minio.RemoveObject(ctx, bucketName, key, minio.RemoveObjectOptions{VersionID: versionID})
+	})
+}
+
+func (client *s3Client) removeBucket(bucketName string) error {
+	return client.Config.Retry.do(client.ctx, "RemoveBucket", bucketName, func(ctx context.Context) error {
+		return client.minio.RemoveBucket(ctx, bucketName)
+	})
+}
+
+// listObjects calls fn for every object under the prefix. A listing failed with a transient error
+// is resumed after the last listed key, so fn sees every object once. An error of fn stops the
+// listing and is returned without retries
+func (client *s3Client) listObjects(bucketName, prefix string, fn func(minio.ObjectInfo) error) error {
+	var startAfter string
+	var fnErr error
+	err := client.Config.Retry.do(client.ctx, "ListObjects", bucketName, func(ctx context.Context) error {
+		// stops the listing goroutine of minio when fn fails
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		for object := range client.minio.ListObjects(ctx, bucketName,
+			minio.ListObjectsOptions{Prefix: prefix, Recursive: true, StartAfter: startAfter}) {
+			if object.Err != nil {
+				return object.Err
+			}
+			if fnErr = fn(object); fnErr != nil {
+				return nil
+			}
+			startAfter = object.Key
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// GetUsage returns the total size and number of objects stored under the prefix
+func (client *s3Client) GetUsage(bucketName string, prefix string) (int64, int64, error) {
+	if prefix != "" {
+		prefix = prefix + "/"
+	}
+	var size, objects int64
+	err := client.listObjects(bucketName, prefix, func(object minio.ObjectInfo) error {
+		size += object.Size
+		objects++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, objects, nil
+}
+
 func (client *s3Client) RemovePrefix(bucketName string, prefix string) error {
 	var err error
 
 	if err = client.removeObjects(bucketName, prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucketName, prefix, minio.RemoveObjectOptions{})
+		return client.removeObject(bucketName, prefix, "")
 	}
 
-	glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
+	klog.InfoS("Failed to remove objects in bulk, removing them one by one", "bucket", bucketName, "prefix", prefix, "err", err)
 
 	if err = client.removeObjectsOneByOne(bucketName, prefix); err == nil {
-		return client.minio.RemoveObject(client.ctx, bucketName, prefix, minio.RemoveObjectOptions{})
+		return client.removeObject(bucketName, prefix, "")
 	}
 
 	return err
@@ -128,101 +228,85 @@ func (client *s3Client) RemoveBucket(bucketName string) error {
 	var err error
 
 	if err = client.removeObjects(bucketName, ""); err == nil {
-		return client.minio.RemoveBucket(client.ctx, bucketName)
+		return client.removeBucket(bucketName)
 	}
 
-	glog.Warningf("removeObjects failed with: %s, will try removeObjectsOneByOne", err)
+	klog.InfoS("Failed to remove objects in bulk, removing them one by one", "bucket", bucketName, "err", err)
 
 	if err = client.removeObjectsOneByOne(bucketName, ""); err == nil {
-		return client.minio.RemoveBucket(client.ctx, bucketName)
+		return client.removeBucket(bucketName)
 	}
 
 	return err
 }
 
-func (client *s3Client) removeObjects(bucketName, prefix string) error {
-	objectsCh := make(chan minio.ObjectInfo)
-	var listErr error
-
-	go func() {
-		defer close(objectsCh)
+// removeBatchSize is the maximum number of keys in one DeleteObjects request
+const removeBatchSize = 1000
 
-		for object := range client.minio.ListObjects(
-			client.ctx,
-			bucketName,
-			minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
-			if object.Err != nil {
-				listErr = object.Err
-				return
-			}
-			objectsCh <- object
+func (client *s3Client) removeObjects(bucketName, prefix string) error {
+	batch := make([]minio.ObjectInfo, 0, removeBatchSize)
+	err := client.listObjects(bucketName, prefix, func(object minio.ObjectInfo) error {
+		batch = append(batch, object)
+		if len(batch) < removeBatchSize {
+			return nil
 		}
-	}()
-
-	if listErr != nil {
-		glog.Error("Error listing objects", listErr)
-		return listErr
+		err := client.removeBatch(bucketName, batch)
+		batch = batch[:0]
+		return err
+	})
+	if err == nil && len(batch) > 0 {
+		err = client.removeBatch(bucketName, batch)
 	}
+	return err
+}
 
-	select {
-	default:
-		opts := minio.RemoveObjectsOptions{
-			GovernanceBypass: true,
-		}
-		errorCh := client.minio.RemoveObjects(client.ctx, bucketName, objectsCh, opts)
-		haveErrWhenRemoveObjects := false
-		for e := range errorCh {
-			glog.Errorf("Failed to remove object %s, error: %s", e.ObjectName, e.Err)
-			haveErrWhenRemoveObjects = true
+// removeBatch removes objects with one DeleteObjects request, repeating it for the objects
+// failed with transient errors
+func (client *s3Client) removeBatch(bucketName string, objects []minio.ObjectInfo) error {
+	remaining := objects
+	err := client.Config.Retry.do(client.ctx, "RemoveObjects", bucketName, func(ctx context.Context) error {
+		objectsCh := make(chan minio.ObjectInfo, len(remaining))
+		for _, object := range remaining {
+			objectsCh <- object
 		}
-		if haveErrWhenRemoveObjects {
-			return fmt.Errorf("Failed to remove all objects of bucket %s", bucketName)
+		close(objectsCh)
+		var failed []minio.ObjectInfo
+		var firstErr error
+		for e := range client.minio.RemoveObjects(ctx, bucketName, objectsCh, minio.RemoveObjectsOptions{GovernanceBypass: true}) {
+			failed = append(failed, minio.ObjectInfo{Key: e.ObjectName, VersionID: e.VersionID})
+			if firstErr == nil {
+				firstErr = e.Err
+			}
 		}
+		remaining = failed
+		return firstErr
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to remove %v objects of bucket %s: %w", len(remaining), bucketName, err)
 	}
-
 	return nil
 }
 
 // will delete files one by one without file lock
 func (client *s3Client) removeObjectsOneByOne(bucketName, prefix string) error {
 	parallelism := 16
-	objectsCh := make(chan minio.ObjectInfo, parallelism)
 	guardCh := make(chan int, parallelism)
-	var listErr error
 	var totalObjects int64 = 0
 	var removeErrors int64 = 0
 
-	go func() {
-		defer close(objectsCh)
-
-		for object := range client.minio.ListObjects(client.ctx, bucketName,
-			minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
-			if object.Err != nil {
-				listErr = object.Err
-				return
-			}
-			atomic.AddInt64(&totalObjects, 1)
-			objectsCh <- object
-		}
-	}()
-
-	if listErr != nil {
-		glog.Error("Error listing objects", listErr)
-		return listErr
-	}
-
-	for object := range objectsCh {
+	listErr := client.listObjects(bucketName, prefix, func(object minio.ObjectInfo) error {
+		totalObjects++
 		guardCh <- 1
 		go func(obj minio.ObjectInfo) {
-			err := client.minio.RemoveObject(client.ctx, bucketName, obj.Key,
-				minio.RemoveObjectOptions{VersionID: obj.VersionID})
+			err := client.removeObject(bucketName, obj.Key, obj.VersionID)
 			if err != nil {
-				glog.Errorf("Failed to remove object %s, error: %s", obj.Key, err)
+				klog.FromContext(client.ctx).Error(err, "Failed to remove object", "bucket", bucketName, "object", obj.Key)
 				atomic.AddInt64(&removeErrors, 1)
 			}
 			<-guardCh
 		}(object)
-	}
+		return nil
+	})
 	for i := 0; i < parallelism; i++ {
 		guardCh <- 1
 	}
@@ -230,6 +314,10 @@ func (client *s3Client) removeObjectsOneByOne(bucketName, prefix string) error {
 		<-guardCh
 	}
 
+	if listErr != nil {
+		klog.FromContext(client.ctx).Error(listErr, "Failed to list objects", "bucket", bucketName, "prefix", prefix)
+		return listErr
+	}
 	if removeErrors > 0 {
 		return fmt.Errorf("Failed to remove %v objects out of total %v of path %s", removeErrors, totalObjects, bucketName)
 	}
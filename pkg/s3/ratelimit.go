@@ -0,0 +1,54 @@
+package s3
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	// DefaultRateLimit is the number of requests per second allowed for each S3 endpoint, 0 means no limit
+	DefaultRateLimit float64 = 0
+	// DefaultRateBurst is the number of requests which may be sent to an endpoint at once
+	DefaultRateBurst = 10
+
+	limitersMu sync.Mutex
+	limiters   = make(map[string]*rate.Limiter)
+)
+
+// endpointLimiter returns the token bucket shared by all clients of the endpoint.
+// Clients are created per CSI request, so the limiter can't be stored in the client itself
+func endpointLimiter(endpoint string, limit float64, burst int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[endpoint]
+	if !ok {
+		l = rate.NewLimiter(rate.Limit(limit), burst)
+		limiters[endpoint] = l
+	} else if l.Limit() != rate.Limit(limit) || l.Burst() != burst {
+		l.SetLimit(rate.Limit(limit))
+		l.SetBurst(burst)
+	}
+	return l
+}
+
+// rateLimitedTransport waits for a token before sending every HTTP request,
+// so that all S3 operations including batched deletes and listings are throttled
+type rateLimitedTransport struct {
+	limiter *rate.Limiter
+	next    http.RoundTripper
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,54 @@
+package s3
+
+import (
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestEndpointLimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		endpoint  string
+		limit     float64
+		burst     int
+		wantNil   bool
+		wantBurst int
+	}{
+		{"unlimited", "unlimited.example.com", 0, 10, true, 0},
+		{"negative limit", "negative.example.com", -1, 10, true, 0},
+		{"limited", "limited.example.com", 5, 10, false, 10},
+		{"burst raised to one", "burst.example.com", 5, 0, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := endpointLimiter(tt.endpoint, tt.limit, tt.burst)
+			if tt.wantNil {
+				if l != nil {
+					t.Fatalf("endpointLimiter(%v) = %v, want nil", tt.limit, l)
+				}
+				return
+			}
+			if l == nil {
+				t.Fatalf("endpointLimiter(%v) = nil", tt.limit)
+			}
+			if l.Limit() != rate.Limit(tt.limit) || l.Burst() != tt.wantBurst {
+				t.Errorf("limiter has limit %v and burst %v, want %v and %v", l.Limit(), l.Burst(), tt.limit, tt.wantBurst)
+			}
+		})
+	}
+}
+
+func TestEndpointLimiterIsShared(t *testing.T) {
+	a := endpointLimiter("shared.example.com:9000", 5, 10)
+	if b := endpointLimiter("shared.example.com:9000", 5, 10); b != a {
+		t.Error("clients of the same endpoint got different limiters")
+	}
+	if other := endpointLimiter("other.example.com:9000", 5, 10); other == a {
+		t.Error("clients of different endpoints share a limiter")
+	}
+	// a changed configuration is applied to the existing limiter
+	if b := endpointLimiter("shared.example.com:9000", 20, 40); b != a || a.Limit() != 20 || a.Burst() != 40 {
+		t.Errorf("limiter was not updated: limit %v, burst %v", a.Limit(), a.Burst())
+	}
+}
@@ -0,0 +1,118 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/metrics"
+	"github.com/yandex-cloud/k8s-csi-s3/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+// RetryPolicy describes how S3 operations are retried on transient errors
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt, 0 disables retries
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry, doubled on every next one
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts
+	MaxBackoff time.Duration
+}
+
+var (
+	// DefaultRetryPolicy is used by all clients created with NewClientFromSecret
+	DefaultRetryPolicy = RetryPolicy{
+		MaxRetries:     5,
+		InitialBackoff: 200 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+	}
+)
+
+// S3 error codes which mean that the request may succeed if repeated later
+var retryableCodes = map[string]bool{
+	"SlowDown":             true,
+	"SlowDownRead":         true,
+	"SlowDownWrite":        true,
+	"ServiceUnavailable":   true,
+	"InternalError":        true,
+	"RequestTimeout":       true,
+	"RequestError":         true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	"RequestThrottled":     true,
+}
+
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	resp := minio.ToErrorResponse(err)
+	return retryableCodes[resp.Code] || retryableStatusCodes[resp.StatusCode]
+}
+
+// backoff returns the delay before retry number attempt (starting from 0)
+// using exponential backoff with full jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 0; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
+
+// do runs op on the bucket and repeats it according to the policy while it fails with a transient error.
+// op gets the context of the traced operation
+func (p RetryPolicy) do(ctx context.Context, name, bucketName string, op func(context.Context) error) error {
+	ctx, span := tracing.Start(ctx, "s3."+name, attribute.String("aws.s3.bucket", bucketName))
+	var err error
+	defer func() {
+		metrics.S3Operation(name, err)
+		tracing.End(span, err)
+	}()
+	for attempt := 0; ; attempt++ {
+		if err = op(ctx); err == nil || attempt >= p.MaxRetries || !isRetryable(err) {
+			return err
+		}
+		delay := p.backoff(attempt)
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.Int("attempt", attempt+1),
+			attribute.String("error", err.Error()),
+			attribute.String("delay", delay.String()),
+		))
+		klog.FromContext(ctx).Info("S3 operation failed with a transient error, retrying", "operation", name,
+			"delay", delay, "attempt", attempt+1, "maxRetries", p.MaxRetries, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		metrics.S3Retry(name)
+	}
+}
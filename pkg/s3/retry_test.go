@@ -0,0 +1,70 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"canceled", context.Canceled, false},
+		{"wrapped canceled", fmt.Errorf("request failed: %w", context.Canceled), false},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"wrapped network error", fmt.Errorf("request failed: %w", &net.DNSError{Err: "timeout", IsTimeout: true}), true},
+		{"slow down", minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable}, true},
+		{"throttling code", minio.ErrorResponse{Code: "RequestLimitExceeded", StatusCode: http.StatusForbidden}, true},
+		{"too many requests", minio.ErrorResponse{StatusCode: http.StatusTooManyRequests}, true},
+		{"bad gateway", minio.ErrorResponse{StatusCode: http.StatusBadGateway}, true},
+		{"no such bucket", minio.ErrorResponse{Code: "NoSuchBucket", StatusCode: http.StatusNotFound}, false},
+		{"access denied", minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden}, false},
+		{"other error", errors.New("invalid argument"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		max     time.Duration
+	}{
+		{"first retry", policy, 0, 100 * time.Millisecond},
+		{"doubled", policy, 1, 200 * time.Millisecond},
+		{"doubled three times", policy, 3, 800 * time.Millisecond},
+		{"capped", policy, 4, time.Second},
+		{"capped far beyond", policy, 100, time.Second},
+		{"initial above max", RetryPolicy{InitialBackoff: 5 * time.Second, MaxBackoff: time.Second}, 0, time.Second},
+		{"zero policy", RetryPolicy{}, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the delay is random, so check its bounds on many samples
+			for i := 0; i < 1000; i++ {
+				d := tt.policy.backoff(tt.attempt)
+				if d > tt.max || (tt.max > 0 && d <= 0) || (tt.max == 0 && d != 0) {
+					t.Fatalf("backoff(%d) = %v, want in (0, %v]", tt.attempt, d, tt.max)
+				}
+			}
+		})
+	}
+}
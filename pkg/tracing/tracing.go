@@ -0,0 +1,124 @@
+// Package tracing exports OpenTelemetry spans of CSI calls, S3 operations and FUSE mounts to an OTLP collector
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// instrumentationName identifies spans of the driver
+const instrumentationName = "github.com/yandex-cloud/k8s-csi-s3"
+
+// Config describes the collector spans are exported to
+type Config struct {
+	// Endpoint is host:port of the OTLP gRPC receiver of the collector
+	Endpoint string
+	// Insecure disables TLS of the connection to the collector
+	Insecure bool
+	// SampleRatio is the share of traces started by the driver which are exported. Traces of callers
+	// are sampled as the caller decided
+	SampleRatio float64
+	// ServiceVersion and NodeID are reported as attributes of the resource of all spans
+	ServiceVersion string
+	NodeID         string
+}
+
+// Setup installs a tracer provider exporting spans to the collector and returns a function
+// which flushes remaining spans and stops the export. Until it's called spans are not recorded
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", "csi-s3"),
+		attribute.String("service.version", cfg.ServiceVersion),
+	}
+	if cfg.NodeID != "" {
+		attrs = append(attrs, attribute.String("k8s.node.name", cfg.NodeID))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of an operation of the driver as a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End marks the span as failed if the operation has returned an error and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// metadataCarrier reads and writes trace context in gRPC metadata
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// UnaryServerInterceptor starts a span for every CSI call, continuing the trace of the caller
+// if it has sent its context in W3C traceparent metadata
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	name := strings.TrimPrefix(info.FullMethod, "/")
+	service, method, _ := strings.Cut(name, "/")
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.service", service),
+		attribute.String("rpc.method", method),
+	}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		attrs = append(attrs, attribute.String("csi.volume_id", r.GetVolumeId()))
+	}
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+	resp, err := handler(ctx, req)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(status.Code(err))))
+	End(span, err)
+	return resp, err
+}